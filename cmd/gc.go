@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/reconciler"
+	"github.com/devops-360-online/go-with-me/internal/repositories"
+	"github.com/devops-360-online/go-with-me/internal/retention"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/devops-360-online/go-with-me/internal/tracing"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+// newReconciler creates the reconciler of the buckets with the references stored by the service
+func newReconciler(cfg *config.Config, db *gorm.DB, mongoClient *mongo.Client, store storage.Storage, options reconciler.Options) (*reconciler.Reconciler, error) {
+	// A presigned upload is not referenced until it is completed
+	if options.GracePeriod < cfg.PresignedUploadTTL {
+		options.GracePeriod = cfg.PresignedUploadTTL
+	}
+	targets := []reconciler.Target{
+		{Bucket: cfg.S3BucketNameEvents, Sources: []reconciler.ReferenceSource{reconciler.EventFileReferences(db)}},
+	}
+	// Without MongoDB the attachments cannot be listed, every file of the chat bucket would look orphaned
+	if mongoClient != nil {
+		targets = append(targets, reconciler.Target{Bucket: cfg.S3BucketNameChatEvent, Sources: []reconciler.ReferenceSource{
+			reconciler.AttachmentReferences(mongoClient.Database(cfg.MongoDatabase).Collection("attachments")),
+		}, KeptPrefixes: []string{retention.ArchivePrefix}})
+	}
+	return reconciler.New(store, targets, options)
+}
+
+// runGCCommand reconciles the buckets once and prints the report, it returns the exit code.
+// Usage: go_with_me gc [-dry-run] [-quarantine=false]
+func runGCCommand(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the orphaned objects")
+	quarantine := flags.Bool("quarantine", cfg.StorageGCQuarantine, "move the orphaned objects to "+reconciler.QuarantinePrefix+" instead of deleting them")
+	gracePeriod := flags.Duration("grace-period", cfg.StorageGCGracePeriod, "keep the orphaned objects more recent than this")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// The counts are exported as metrics too when the collector is reachable
+	if mp, err := tracing.InitMeter(); err == nil {
+		defer mp.Shutdown(context.Background())
+	}
+
+	db, err := repositories.NewDatabase(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to database: %v\n", err)
+		return 1
+	}
+	mongoClient, err := repositories.NewMongoClient(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to MongoDB: %v\n", err)
+		return 1
+	}
+	defer mongoClient.Disconnect(context.Background())
+	store, err := storage.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize storage: %v\n", err)
+		return 1
+	}
+	rec, err := newReconciler(cfg, db, mongoClient, store, reconciler.Options{
+		GracePeriod:         *gracePeriod,
+		Quarantine:          *quarantine,
+		QuarantineRetention: cfg.StorageGCRetention,
+		DryRun:              *dryRun,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize the reconciler: %v\n", err)
+		return 1
+	}
+
+	reports, err := rec.Run(context.Background())
+	for _, report := range reports {
+		fmt.Printf("%s: scanned=%d referenced=%d recent=%d orphaned=%d deleted=%d quarantined=%d purged=%d failed=%d\n",
+			report.Bucket, report.Scanned, report.Referenced, report.Recent, report.Orphaned,
+			report.Deleted, report.Quarantined, report.Purged, report.Failed)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reconciliation failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -4,14 +4,23 @@ import (
 	"context"
 	"log"
 	"fmt"
+	"os"
+	"time"
 
+	"github.com/IBM/sarama"
 	"github.com/gin-gonic/gin"
 	//jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/contentfilter"
 	"github.com/devops-360-online/go-with-me/internal/handlers"
 	"github.com/devops-360-online/go-with-me/internal/middlewares"
 	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/notifications"
+	"github.com/devops-360-online/go-with-me/internal/ratelimit"
+	"github.com/devops-360-online/go-with-me/internal/reconciler"
 	"github.com/devops-360-online/go-with-me/internal/repositories"
+	"github.com/devops-360-online/go-with-me/internal/retention"
+	"github.com/devops-360-online/go-with-me/internal/storage"
 	"github.com/devops-360-online/go-with-me/internal/tracing"
 	"github.com/devops-360-online/go-with-me/internal/websockets"
 	"github.com/devops-360-online/go-with-me/internal/logger"
@@ -20,6 +29,12 @@ import (
 
 func main() {
 	cfg := config.LoadConfig()
+
+	// The gc subcommand reconciles the buckets once instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		os.Exit(runGCCommand(cfg, os.Args[2:]))
+	}
+
 	router := gin.Default()
 
 	// Apply middlewares
@@ -51,6 +66,18 @@ func main() {
 		}
 	}()
 
+	// Initialize the meter
+	mp, err := tracing.InitMeter()
+	if err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to initialize meter: %v", err), "", nil)
+	} else {
+		defer func() {
+			if err := mp.Shutdown(context.Background()); err != nil {
+				logger.LogMessage("error", fmt.Sprintf("Failed to shutdown meter provider: %v", err), "", nil)
+			}
+		}()
+	}
+
 	// Apply Tracing Middleware
 	router.Use(middlewares.TracingMiddleware())
 
@@ -61,7 +88,10 @@ func main() {
 	}
 
 	// Migrate the schema
-	db.AutoMigrate(&models.User{}, &models.Event{})
+	db.AutoMigrate(&models.User{}, &models.Event{}, &models.EventImage{}, &models.Comment{}, &models.Review{}, &models.UserBlock{})
+	if err := models.BackfillEventFileKeys(db, cfg.S3BucketNameEvents); err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to backfill the event file keys: %v", err), "", nil)
+	}
 
 	// Add db to context
 	router.Use(func(c *gin.Context) {
@@ -69,6 +99,116 @@ func main() {
 		c.Next()
 	})
 
+	// Initialize the object storage (S3, GCS or local filesystem)
+	store, err := storage.New(cfg)
+	if err != nil {
+		logger.LogMessage("fatal", fmt.Sprintf("Failed to initialize storage: %v", err), "", nil)
+	}
+
+	// Add storage to context
+	router.Use(func(c *gin.Context) {
+		c.Set("storage", store)
+		c.Next()
+	})
+
+	// Create the buckets when they do not exist, the readiness probe fails until it succeeds
+	go provisionStorage(store, cfg)
+
+	// The images uploaded directly to the bucket go through the image pipeline before they are visible
+	uploadProcessor := handlers.NewUploadProcessor(db, cfg, store)
+	go uploadProcessor.Start(context.Background(), time.Minute)
+	router.Use(func(c *gin.Context) {
+		c.Set("uploadProcessor", uploadProcessor)
+		c.Next()
+	})
+
+	// Initialize Redis client
+	rdb := repositories.NewRedisClient(cfg)
+
+	// Initialize MongoDB client
+	mongoClient, err := repositories.NewMongoClient(cfg)
+	if err != nil {
+		logger.LogMessage("fatal", fmt.Sprintf("Failed to connect to MongoDB: %v", err), "", nil)
+	} else if err := repositories.EnsureChatIndexes(context.Background(), mongoClient.Database(cfg.MongoDatabase)); err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to create the chat indexes: %v", err), "", nil)
+	}
+
+	// The websocket hub delivers the chat messages published by every replica
+	hub := websockets.NewHub(rdb)
+	go hub.Run(context.Background())
+	// The presence of the chat users is shared by the replicas in Redis
+	presence := websockets.NewPresence(rdb)
+
+	// The mentions are notified in the app, and by email when a topic is configured
+	var producer sarama.SyncProducer
+	if cfg.NotificationEmailTopic != "" {
+		if producer, err = repositories.NewKafkaSyncProducer(cfg); err != nil {
+			logger.LogMessage("error", fmt.Sprintf("Failed to create the Kafka producer, the notification emails are disabled: %v", err), "", nil)
+		} else {
+			defer producer.Close()
+		}
+	}
+	var notifier *notifications.Notifier
+	if mongoClient != nil {
+		notifier = notifications.New(mongoClient.Database(cfg.MongoDatabase).Collection("notifications"), hub, producer, cfg.NotificationEmailTopic)
+	}
+
+	// The messages are limited by user and room, and checked by the content filter.
+	// The default filter refuses the configured words and the links.
+	chatLimiter := ratelimit.NewTokenBucket(rdb, "ratelimit:chat:", cfg.ChatRateBurst, cfg.ChatRateRefill)
+	// The typing and read actions are cheaper and more frequent, they have their own buckets
+	chatSignalLimiter := ratelimit.NewTokenBucket(rdb, "ratelimit:chat:signal:", cfg.ChatSignalRateBurst, cfg.ChatSignalRateRefill)
+	contentFilter := contentfilter.Chain{contentfilter.NewWordList(cfg.ChatBlockedWords)}
+	if cfg.ChatBlockLinks {
+		contentFilter = append(contentFilter, contentfilter.NewLinkBlocker(cfg.ChatAllowedLinkHosts))
+	}
+
+	// Add the chat clients to context, the chat routes are registered below
+	router.Use(func(c *gin.Context) {
+		c.Set("mongoClient", mongoClient)
+		c.Set("redisClient", rdb)
+		c.Set("hub", hub)
+		c.Set("presence", presence)
+		c.Set("notifier", notifier)
+		c.Set("chatLimiter", chatLimiter)
+		c.Set("chatSignalLimiter", chatSignalLimiter)
+		c.Set("contentFilter", contentfilter.Filter(contentFilter))
+		c.Next()
+	})
+
+	// Remove the files which are not referenced anymore
+	if cfg.StorageGCInterval > 0 {
+		rec, err := newReconciler(cfg, db, mongoClient, store, reconciler.Options{
+			GracePeriod:         cfg.StorageGCGracePeriod,
+			Quarantine:          cfg.StorageGCQuarantine,
+			QuarantineRetention: cfg.StorageGCRetention,
+		})
+		if err != nil {
+			logger.LogMessage("fatal", fmt.Sprintf("Failed to initialize the storage reconciler: %v", err), "", nil)
+		} else {
+			go rec.Start(context.Background(), cfg.StorageGCInterval)
+		}
+	}
+
+	// Remove the chats of the events once their retention is over, archiving them first when enabled
+	if cfg.ChatRetentionInterval > 0 && mongoClient != nil {
+		sweeper, err := retention.New(db, mongoClient.Database(cfg.MongoDatabase), rdb, store, retention.Options{
+			DefaultRetention: cfg.ChatRetention,
+			Archive:          cfg.ChatArchive,
+			Bucket:           cfg.S3BucketNameChatEvent,
+		})
+		if err != nil {
+			logger.LogMessage("error", fmt.Sprintf("Failed to initialize the chat retention sweeper: %v", err), "", nil)
+		} else {
+			go sweeper.Start(context.Background(), cfg.ChatRetentionInterval)
+		}
+	}
+
+	// The local storage files are served by the API with the signature of their URL
+	if cfg.StorageDriver == "local" {
+		router.GET("/media/:bucket/*key", handlers.LocalMediaHandler)
+	}
+
 	// Initialize authentication middleware
 	authMiddleware, err := middlewares.AuthMiddleware()
 	if err != nil {
@@ -76,6 +216,8 @@ func main() {
 	}
 
 	// Public routes
+	router.GET("/healthz", handlers.LivenessHandler)
+	router.GET("/readyz", handlers.ReadinessHandler)
 	router.POST("/register", handlers.RegisterHandler)
 	router.POST("/login", authMiddleware.LoginHandler)
 
@@ -86,31 +228,63 @@ func main() {
 		auth.POST("/events", handlers.CreateEventHandler)
 		auth.GET("/events", handlers.ListEventsHandler)
 		auth.GET("/events/:id", handlers.GetEventHandler)
+		auth.PATCH("/events/:id", handlers.UpdateEventHandler)
+		auth.POST("/events/:id/cancel", handlers.CancelEventHandler)
 		auth.POST("/events/:id/join", handlers.JoinEventHandler)
 		auth.DELETE("/events/:id/join", handlers.UnjoinEventHandler)
-		auth.GET("/ws/events/:id", func(c *gin.Context) {
-			handlers.EventChatHandler(c)
-		})
+		auth.GET("/events/:id/images", handlers.ListEventImagesHandler)
+		auth.POST("/events/:id/images", handlers.UploadEventImagesHandler)
+		auth.POST("/events/:id/uploads", handlers.CreateUploadURLHandler)
+		auth.POST("/events/:id/uploads/complete", handlers.CompleteUploadHandler)
+		auth.PUT("/events/:id/images/order", handlers.ReorderEventImagesHandler)
+		auth.PATCH("/events/:id/images/:imageId", handlers.UpdateEventImageHandler)
+		auth.POST("/events/:id/images/:imageId/moderation", handlers.ModerateEventImageHandler)
+		auth.DELETE("/events/:id/images/:imageId", handlers.DeleteEventImageHandler)
+		auth.GET("/events/:id/comments", handlers.ListCommentsHandler)
+		auth.POST("/events/:id/comments", handlers.CreateCommentHandler)
+		auth.DELETE("/events/:id/comments/:commentId", handlers.DeleteCommentHandler)
+		auth.GET("/events/:id/reviews", handlers.ListReviewsHandler)
+		auth.POST("/events/:id/reviews", handlers.CreateReviewHandler)
+		auth.POST("/events/:id/attachments", handlers.UploadAttachmentHandler)
+		auth.GET("/events/:id/messages", handlers.ListMessagesHandler)
+		auth.POST("/events/:id/messages", handlers.SendMessageHandler)
+		auth.GET("/events/:id/messages/search", handlers.SearchMessagesHandler)
+		auth.PATCH("/events/:id/messages/:messageId", handlers.EditMessageHandler)
+		auth.DELETE("/events/:id/messages/:messageId", handlers.DeleteMessageHandler)
+		auth.GET("/events/:id/messages/:messageId/edits", handlers.ListMessageEditsHandler)
+		auth.GET("/events/:id/messages/:messageId/thread", handlers.ThreadHandler)
+		auth.GET("/events/:id/sanctions", handlers.ListSanctionsHandler)
+		auth.POST("/events/:id/sanctions", handlers.SanctionUserHandler)
+		auth.DELETE("/events/:id/sanctions/:userId", handlers.LiftSanctionHandler)
+		auth.GET("/events/:id/presence", handlers.EventPresenceHandler)
+		auth.POST("/events/:id/read", handlers.MarkReadHandler)
+		auth.GET("/me/unread", handlers.UnreadHandler)
+		auth.GET("/me/notifications", handlers.ListNotificationsHandler)
+		auth.POST("/me/notifications/read", handlers.ReadNotificationsHandler)
+		auth.GET("/me/blocks", handlers.ListBlocksHandler)
+		auth.POST("/me/blocks", handlers.BlockUserHandler)
+		auth.DELETE("/me/blocks/:userId", handlers.UnblockUserHandler)
+		auth.GET("/conversations", handlers.ListConversationsHandler)
+		auth.POST("/conversations", handlers.CreateConversationHandler)
+		auth.GET("/conversations/:id/messages", handlers.ListConversationMessagesHandler)
+		auth.POST("/conversations/:id/messages", handlers.SendConversationMessageHandler)
+		auth.POST("/conversations/:id/stream/tickets", handlers.CreateConversationStreamTicketHandler)
+		auth.GET("/users/:id", handlers.GetUserProfileHandler)
+		auth.POST("/ws/tickets", handlers.CreateWebsocketTicketHandler)
+		auth.POST("/events/:id/stream/tickets", handlers.CreateStreamTicketHandler)
 	}
 
-	// Initialize Redis client
-	rdb := repositories.NewRedisClient(cfg)
-	router.Use(middlewares.CacheMiddleware(rdb))
+	// Websockets accept a ticket instead of the Authorization header
+	router.GET("/ws/events/:id", middlewares.WebsocketAuth(authMiddleware, rdb), handlers.EventChatHandler)
+	router.GET("/ws/events/:id/live", middlewares.WebsocketAuth(authMiddleware, rdb), handlers.EventViewerHandler)
+	router.GET("/ws/me", middlewares.WebsocketAuth(authMiddleware, rdb), handlers.UserSocketHandler)
+	router.GET("/ws/conversations/:id", middlewares.WebsocketAuth(authMiddleware, rdb), handlers.ConversationChatHandler)
+	// The event streams too, EventSource cannot send headers either: their tickets are bound to the stream
+	router.GET("/events/:id/stream", middlewares.StreamAuth(authMiddleware, rdb, middlewares.StreamRouteChat), handlers.EventStreamHandler)
+	router.GET("/events/:id/live", middlewares.StreamAuth(authMiddleware, rdb, middlewares.StreamRouteLive), handlers.EventViewerStreamHandler)
+	router.GET("/conversations/:id/stream", middlewares.StreamAuth(authMiddleware, rdb, middlewares.StreamRouteConversation), handlers.ConversationStreamHandler)
 
-	// Initialize MongoDB client
-	mongoClient, err := repositories.NewMongoClient(cfg)
-	if err != nil {
-		logger.LogMessage("fatal", fmt.Sprintf("Failed to connect to MongoDB: %v", err), "", nil)
-	}
-
-	// Add MongoDB client to context
-	router.Use(func(c *gin.Context) {
-		c.Set("mongoClient", mongoClient)
-		c.Next()
-	})
-
-	// Start WebSocket hub
-	go websockets.RunHub(rdb)
+	router.Use(middlewares.CacheMiddleware(rdb))
 
 	// Start the server
 	if err := router.Run(":" + cfg.ServerPort); err != nil {
@@ -118,3 +292,24 @@ func main() {
 		logger.LogMessage("fatal", fmt.Sprintf("Failed to run server: %v", err), "", nil)
 	}
 }
+
+// provisionStorage ensures the buckets exist with their policy, CORS and lifecycle rules,
+// retrying while the storage backend is unreachable
+func provisionStorage(store storage.Storage, cfg *config.Config) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := storage.EnsureBuckets(ctx, store, storage.Buckets(cfg))
+		cancel()
+		if err == nil {
+			logger.LogMessage("info", "Storage buckets are ready", "", nil)
+			// The objects stored when the buckets were public keep their ACL, they are made private once.
+			// It can take a while on a large bucket, it is retried on the next start when it fails.
+			if err := storage.MakeBucketsPrivate(context.Background(), store, storage.Buckets(cfg)); err != nil {
+				logger.LogMessage("error", fmt.Sprintf("Failed to make the stored objects private: %v", err), "", nil)
+			}
+			return
+		}
+		logger.LogMessage("error", fmt.Sprintf("Storage provisioning failed, retrying: %v", err), "", nil)
+		time.Sleep(10 * time.Second)
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -24,11 +25,70 @@ type Config struct {
 	S3Region                 string
 	OtelExporterOTLPEndpoint string
 	S3Endpoint               string
+	StorageDriver            string
+	StoragePublicURL         string
+	StorageLocalPath         string
+	StorageCORSOrigins       []string
+	MediaURLTTL              time.Duration
+	MediaSigningKey          string
+	StorageGCInterval        time.Duration
+	StorageGCGracePeriod     time.Duration
+	StorageGCQuarantine      bool
+	StorageGCRetention       time.Duration
+	GCSAccessKeyID           string
+	GCSSecretAccessKey       string
+	MaxUploadBytes           int64
+	MaxImageDimension        int
+	ImageThumbnailSize       int
+	ImageWebPSize            int
+	PresignedUploadTTL       time.Duration
+	ChatAttachmentMaxBytes   int64
+	ChatEventQuotaBytes      int64
+	ChatEditWindow           time.Duration
+	NotificationEmailTopic   string
+	ChatMessageMaxLength     int
+	ChatRateBurst            int
+	ChatRateRefill           time.Duration
+	ChatSignalRateBurst      int
+	ChatSignalRateRefill     time.Duration
+	ChatBlockedWords         []string
+	ChatBlockLinks           bool
+	ChatAllowedLinkHosts     []string
+	ChatRetention            time.Duration
+	ChatRetentionInterval    time.Duration
+	ChatArchive              bool
+	WebsocketAllowedOrigins  []string
 	// Add other configurations as needed
 }
 
 func LoadConfig() *Config {
 	viper.SetConfigFile(".env")
+	viper.SetDefault("STORAGE_DRIVER", "s3")
+	viper.SetDefault("STORAGE_LOCAL_PATH", "./data/storage")
+	viper.SetDefault("STORAGE_CORS_ORIGINS", "*")
+	viper.SetDefault("MEDIA_URL_TTL", "15m")
+	viper.SetDefault("STORAGE_GC_INTERVAL", "24h") // 0 disables the background reconciler
+	viper.SetDefault("STORAGE_GC_GRACE_PERIOD", "24h")
+	viper.SetDefault("STORAGE_GC_QUARANTINE", true)
+	viper.SetDefault("STORAGE_GC_RETENTION", "168h")
+	viper.SetDefault("MAX_UPLOAD_BYTES", 10<<20) // 10 MiB
+	viper.SetDefault("MAX_IMAGE_DIMENSION", 8000)
+	viper.SetDefault("IMAGE_THUMBNAIL_SIZE", 320)
+	viper.SetDefault("IMAGE_WEBP_SIZE", 1600)
+	viper.SetDefault("PRESIGNED_UPLOAD_TTL", "15m")
+	viper.SetDefault("CHAT_ATTACHMENT_MAX_BYTES", 25<<20) // 25 MiB
+	viper.SetDefault("CHAT_EVENT_QUOTA_BYTES", 500<<20)   // 500 MiB per event
+	viper.SetDefault("CHAT_EDIT_WINDOW", "15m")
+	viper.SetDefault("NOTIFICATION_EMAIL_TOPIC", "") // empty disables the emails
+	viper.SetDefault("CHAT_MESSAGE_MAX_LENGTH", 4000)
+	viper.SetDefault("CHAT_RATE_BURST", 5)            // messages sent at once
+	viper.SetDefault("CHAT_RATE_REFILL", "2s")        // then one message every refill, 0 disables the limit
+	viper.SetDefault("CHAT_SIGNAL_RATE_BURST", 10)    // typing and read actions sent at once
+	viper.SetDefault("CHAT_SIGNAL_RATE_REFILL", "1s") // then one every refill, 0 disables the limit
+	viper.SetDefault("CHAT_BLOCK_LINKS", true)
+	viper.SetDefault("CHAT_RETENTION", "2160h")       // 90 days after the event, 0 keeps the chats forever
+	viper.SetDefault("CHAT_RETENTION_INTERVAL", "1h") // 0 disables the background sweeper
+	viper.SetDefault("CHAT_ARCHIVE", true)
 	err := viper.ReadInConfig()
 	if err != nil {
 		log.Fatalf("Error reading config file, %s", err)
@@ -51,7 +111,40 @@ func LoadConfig() *Config {
 		S3BucketNameChatEvent:    viper.GetString("S3_BUCKET_CHAT"),
 		S3Region:                 viper.GetString("DEFAULT_S3_REGION"),
 		S3Endpoint:               viper.GetString("S3_ENDPOINT"),
+		StorageDriver:            viper.GetString("STORAGE_DRIVER"),
+		StoragePublicURL:         viper.GetString("STORAGE_PUBLIC_URL"),
+		StorageLocalPath:         viper.GetString("STORAGE_LOCAL_PATH"),
+		StorageCORSOrigins:       viper.GetStringSlice("STORAGE_CORS_ORIGINS"),
+		MediaURLTTL:              viper.GetDuration("MEDIA_URL_TTL"),
+		MediaSigningKey:          viper.GetString("MEDIA_SIGNING_KEY"),
+		StorageGCInterval:        viper.GetDuration("STORAGE_GC_INTERVAL"),
+		StorageGCGracePeriod:     viper.GetDuration("STORAGE_GC_GRACE_PERIOD"),
+		StorageGCQuarantine:      viper.GetBool("STORAGE_GC_QUARANTINE"),
+		StorageGCRetention:       viper.GetDuration("STORAGE_GC_RETENTION"),
+		GCSAccessKeyID:           viper.GetString("GCS_HMAC_ACCESS_KEY_ID"),
+		GCSSecretAccessKey:       viper.GetString("GCS_HMAC_SECRET"),
 		OtelExporterOTLPEndpoint: viper.GetString("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		MaxUploadBytes:           viper.GetInt64("MAX_UPLOAD_BYTES"),
+		MaxImageDimension:        viper.GetInt("MAX_IMAGE_DIMENSION"),
+		ImageThumbnailSize:       viper.GetInt("IMAGE_THUMBNAIL_SIZE"),
+		ImageWebPSize:            viper.GetInt("IMAGE_WEBP_SIZE"),
+		PresignedUploadTTL:       viper.GetDuration("PRESIGNED_UPLOAD_TTL"),
+		ChatAttachmentMaxBytes:   viper.GetInt64("CHAT_ATTACHMENT_MAX_BYTES"),
+		ChatEventQuotaBytes:      viper.GetInt64("CHAT_EVENT_QUOTA_BYTES"),
+		ChatEditWindow:           viper.GetDuration("CHAT_EDIT_WINDOW"),
+		NotificationEmailTopic:   viper.GetString("NOTIFICATION_EMAIL_TOPIC"),
+		ChatMessageMaxLength:     viper.GetInt("CHAT_MESSAGE_MAX_LENGTH"),
+		ChatRateBurst:            viper.GetInt("CHAT_RATE_BURST"),
+		ChatRateRefill:           viper.GetDuration("CHAT_RATE_REFILL"),
+		ChatSignalRateBurst:      viper.GetInt("CHAT_SIGNAL_RATE_BURST"),
+		ChatSignalRateRefill:     viper.GetDuration("CHAT_SIGNAL_RATE_REFILL"),
+		ChatBlockedWords:         viper.GetStringSlice("CHAT_BLOCKED_WORDS"),
+		ChatBlockLinks:           viper.GetBool("CHAT_BLOCK_LINKS"),
+		ChatAllowedLinkHosts:     viper.GetStringSlice("CHAT_ALLOWED_LINK_HOSTS"),
+		ChatRetention:            viper.GetDuration("CHAT_RETENTION"),
+		ChatRetentionInterval:    viper.GetDuration("CHAT_RETENTION_INTERVAL"),
+		ChatArchive:              viper.GetBool("CHAT_ARCHIVE"),
+		WebsocketAllowedOrigins:  viper.GetStringSlice("WS_ALLOWED_ORIGINS"),
 		// Add other configurations as needed
 	}
 
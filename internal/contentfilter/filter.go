@@ -0,0 +1,126 @@
+package contentfilter
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rejection is the error of a content refused by a filter, its reason is shown to the sender
+type Rejection struct {
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return r.Reason
+}
+
+// Filter checks the content of a message before it is saved, it returns a *Rejection to refuse it
+type Filter interface {
+	Check(content string) error
+}
+
+// Chain runs the filters in order and stops at the first rejection
+type Chain []Filter
+
+func (c Chain) Check(content string) error {
+	for _, filter := range c {
+		if err := filter.Check(content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WordList refuses the contents with one of its words or phrases, whole words whatever the case
+type WordList struct {
+	words []string
+}
+
+func NewWordList(words []string) *WordList {
+	list := &WordList{}
+	for _, word := range words {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			list.words = append(list.words, word)
+		}
+	}
+	return list
+}
+
+func (l *WordList) Check(content string) error {
+	lower := strings.ToLower(content)
+	for _, word := range l.words {
+		for offset := 0; offset < len(lower); {
+			index := strings.Index(lower[offset:], word)
+			if index < 0 {
+				break
+			}
+			start, end := offset+index, offset+index+len(word)
+			if isBoundary(lower, start, end) {
+				return &Rejection{Reason: "The message contains a forbidden word"}
+			}
+			offset = start + 1
+		}
+	}
+	return nil
+}
+
+// isBoundary reports whether the match is not part of a longer word
+func isBoundary(content string, start, end int) bool {
+	if start > 0 {
+		before, _ := utf8.DecodeLastRuneInString(content[:start])
+		if unicode.IsLetter(before) || unicode.IsDigit(before) {
+			return false
+		}
+	}
+	if end < len(content) {
+		after, _ := utf8.DecodeRuneInString(content[end:])
+		if unicode.IsLetter(after) || unicode.IsDigit(after) {
+			return false
+		}
+	}
+	return true
+}
+
+// linkPattern matches the links with a scheme or starting with www.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)[^\s<>"]+`)
+
+// LinkBlocker refuses the contents with links, except to the allowed hosts and their subdomains
+type LinkBlocker struct {
+	allowedHosts []string
+}
+
+func NewLinkBlocker(allowedHosts []string) *LinkBlocker {
+	blocker := &LinkBlocker{}
+	for _, host := range allowedHosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			blocker.allowedHosts = append(blocker.allowedHosts, host)
+		}
+	}
+	return blocker
+}
+
+func (b *LinkBlocker) Check(content string) error {
+	for _, link := range linkPattern.FindAllString(content, -1) {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		parsed, err := url.Parse(link)
+		if err != nil || !b.allowed(parsed.Hostname()) {
+			return &Rejection{Reason: "Links are not allowed in the chat"}
+		}
+	}
+	return nil
+}
+
+func (b *LinkBlocker) allowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range b.allowedHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
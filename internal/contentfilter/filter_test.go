@@ -0,0 +1,87 @@
+package contentfilter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWordList(t *testing.T) {
+	list := NewWordList([]string{"Spam", " scam offer ", ""})
+	tests := []struct {
+		content  string
+		rejected bool
+	}{
+		{"hello everyone", false},
+		{"this is spam", true},
+		{"SPAM!", true},
+		{"(spam)", true},
+		{"spammer", false},
+		{"antispam", false},
+		{"spam2", false},
+		{"a scam offer for you", true},
+		{"a scam offers", false},
+		{"écrit spam", true},
+		{"éspam", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			err := list.Check(tt.content)
+			var rejection *Rejection
+			if rejected := errors.As(err, &rejection); rejected != tt.rejected {
+				t.Fatalf("Check(%q) = %v, want rejected %v", tt.content, err, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestLinkBlocker(t *testing.T) {
+	blocker := NewLinkBlocker([]string{"Example.com", " "})
+	tests := []struct {
+		content  string
+		rejected bool
+	}{
+		{"no link here", false},
+		{"see https://example.com/event", false},
+		{"see http://maps.example.com/?q=1", false},
+		{"www.example.com is fine", false},
+		{"see https://evil.test/login", true},
+		{"WWW.EVIL.TEST", true},
+		{"ftp://files.test/a", true},
+		{"https://example.com.evil.test", true},
+		{"https://notexample.com", true},
+		{"example.com without scheme", false},
+		{"fine https://example.com and bad https://evil.test", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			err := blocker.Check(tt.content)
+			var rejection *Rejection
+			if rejected := errors.As(err, &rejection); rejected != tt.rejected {
+				t.Fatalf("Check(%q) = %v, want rejected %v", tt.content, err, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestChainStopsAtTheFirstRejection(t *testing.T) {
+	chain := Chain{NewWordList([]string{"spam"}), NewLinkBlocker(nil)}
+	tests := []struct {
+		content string
+		reason  string
+	}{
+		{"hello", ""},
+		{"spam https://evil.test", "The message contains a forbidden word"},
+		{"https://evil.test", "Links are not allowed in the chat"},
+	}
+	for _, tt := range tests {
+		err := chain.Check(tt.content)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		}
+		if reason != tt.reason {
+			t.Fatalf("Check(%q) = %q, want %q", tt.content, reason, tt.reason)
+		}
+	}
+}
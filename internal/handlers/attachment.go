@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/media"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// maxMessageAttachments limits the number of files sent in a single chat message
+const maxMessageAttachments = 10
+
+// allowedAttachmentTypes maps the sniffed content types accepted in the chat to their extension
+var allowedAttachmentTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"text/plain":      ".txt",
+}
+
+var (
+	errInvalidAttachments = errors.New("attachments not found or already sent")
+	errTooManyAttachments = fmt.Errorf("a message can contain at most %d attachments", maxMessageAttachments)
+)
+
+// attachmentsCollection returns the collection of the chat attachments
+func attachmentsCollection(c *gin.Context) *mongo.Collection {
+	cfg := c.MustGet("config").(*config.Config)
+	mongoClient := c.MustGet("mongoClient").(*mongo.Client)
+	return mongoClient.Database(cfg.MongoDatabase).Collection("attachments")
+}
+
+// isChatParticipant reports whether the user can take part in the chat of the event
+func isChatParticipant(db *gorm.DB, event *models.Event, userID uint) (bool, error) {
+	if event.CreatorID == userID {
+		return true, nil
+	}
+	return models.IsEventMember(db, userID, event.ID)
+}
+
+// signAttachments fills the URLs of the attachments and of their thumbnails.
+// Callers must have checked the user takes part in the chat.
+func signAttachments(ctx context.Context, cfg *config.Config, store storage.Storage, attachments []models.MessageAttachment) error {
+	for i := range attachments {
+		attachment := &attachments[i]
+		signed, err := store.PresignGet(ctx, cfg.S3BucketNameChatEvent, attachment.Key, cfg.MediaURLTTL)
+		if err != nil {
+			return err
+		}
+		attachment.URL = signed
+		if attachment.ThumbnailKey != "" {
+			if attachment.ThumbnailURL, err = store.PresignGet(ctx, cfg.S3BucketNameChatEvent, attachment.ThumbnailKey, cfg.MediaURLTTL); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteChatFiles removes files of the chat bucket, the failures are only logged
+func deleteChatFiles(ctx context.Context, cfg *config.Config, store storage.Storage, keys ...string) {
+	for _, key := range keys {
+		if err := store.Delete(ctx, cfg.S3BucketNameChatEvent, key); err != nil {
+			logger.LogMessage("error", fmt.Sprintf("Failed to delete attachment %s: %v", key, err), "", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	}
+}
+
+// chatUsedBytes sums the size of the attachments uploaded in the chat of the event and of their thumbnails
+func chatUsedBytes(ctx context.Context, collection *mongo.Collection, eventID uint) (int64, error) {
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"event_id": eventID}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": bson.M{
+			"$add": bson.A{"$size", bson.M{"$ifNull": bson.A{"$thumbnail_size", 0}}},
+		}}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Total int64 `bson:"total"`
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Total, nil
+}
+
+// reserveChatQuota saves the attachment before its files are uploaded, then checks the files of the chat of the event
+// still fit in the quota. The check follows the insert so concurrent uploads see each other: when they do not fit
+// together they are all refused, the quota is never exceeded. It returns false when the attachment was refused and removed.
+func reserveChatQuota(ctx context.Context, collection *mongo.Collection, attachment *models.Attachment, quota int64) (bool, error) {
+	if attachment.Size+attachment.ThumbnailSize > quota {
+		return false, nil
+	}
+	if _, err := collection.InsertOne(ctx, attachment); err != nil {
+		return false, err
+	}
+	used, err := chatUsedBytes(ctx, collection, attachment.EventID)
+	if err == nil && used <= quota {
+		return true, nil
+	}
+	if _, deleteErr := collection.DeleteOne(ctx, bson.M{"_id": attachment.ID}); deleteErr != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to release the chat quota: %v", deleteErr), "", map[string]interface{}{
+			"attachment_id": attachment.ID.Hex(),
+		})
+	}
+	return false, err
+}
+
+// attachmentName keeps the base name of the uploaded file, it is only displayed
+func attachmentName(filename string) string {
+	name := filepath.Base(filepath.Clean("/" + filename))
+	if name == "/" || !utf8.ValidString(name) {
+		return "attachment"
+	}
+	if runes := []rune(name); len(runes) > 255 {
+		name = string(runes[:255])
+	}
+	return name
+}
+
+// claimAttachments marks the attachments uploaded by the user as sent in the message and returns their metadata.
+// The update is conditional so an attachment cannot be sent twice.
+func claimAttachments(ctx context.Context, collection *mongo.Collection, eventID, userID uint, ids []string, messageID primitive.ObjectID) ([]models.MessageAttachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if len(ids) > maxMessageAttachments {
+		return nil, errTooManyAttachments
+	}
+	objectIDs := make([]primitive.ObjectID, 0, len(ids))
+	seen := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		objectID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, errInvalidAttachments
+		}
+		if !seen[objectID] {
+			seen[objectID] = true
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+
+	filter := bson.M{"_id": bson.M{"$in": objectIDs}, "event_id": eventID, "uploader_id": userID, "attached": false}
+	result, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"attached": true, "message_id": messageID}})
+	if err != nil {
+		return nil, err
+	}
+	if result.ModifiedCount != int64(len(objectIDs)) {
+		// Give back the attachments claimed by this call
+		releaseAttachments(ctx, collection, messageID)
+		return nil, errInvalidAttachments
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"message_id": messageID})
+	if err != nil {
+		releaseAttachments(ctx, collection, messageID)
+		return nil, err
+	}
+	var attachments []models.Attachment
+	if err := cursor.All(ctx, &attachments); err != nil {
+		releaseAttachments(ctx, collection, messageID)
+		return nil, err
+	}
+
+	// Keep the order chosen by the sender
+	byID := make(map[primitive.ObjectID]models.MessageAttachment, len(attachments))
+	for _, attachment := range attachments {
+		byID[attachment.ID] = attachment.MessageAttachment
+	}
+	metadata := make([]models.MessageAttachment, 0, len(objectIDs))
+	for _, id := range objectIDs {
+		if attachment, ok := byID[id]; ok {
+			metadata = append(metadata, attachment)
+		}
+	}
+	return metadata, nil
+}
+
+// releaseAttachments makes the attachments of a message which could not be sent available again
+func releaseAttachments(ctx context.Context, collection *mongo.Collection, messageID primitive.ObjectID) {
+	_, err := collection.UpdateMany(ctx, bson.M{"message_id": messageID}, bson.M{
+		"$set":   bson.M{"attached": false},
+		"$unset": bson.M{"message_id": ""},
+	})
+	if err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to release attachments: %v", err), "", map[string]interface{}{
+			"message_id": messageID.Hex(),
+		})
+	}
+}
+
+// UploadAttachmentHandler stores a file in the chat bucket so a participant can send it in a message of the event chat.
+// The returned id is sent in the attachment_ids of the message.
+func UploadAttachmentHandler(c *gin.Context) {
+	tracer := otel.Tracer("event-service")
+	ctx, span := tracer.Start(c.Request.Context(), "UploadAttachmentHandler")
+	defer span.End()
+
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+	if fileHeader.Size > cfg.ChatAttachmentMaxBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("file is too large: maximum size is %d bytes", cfg.ChatAttachmentMaxBytes)})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, cfg.ChatAttachmentMaxBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	if int64(len(data)) > cfg.ChatAttachmentMaxBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("file is too large: maximum size is %d bytes", cfg.ChatAttachmentMaxBytes)})
+		return
+	}
+
+	// The type is sniffed from the content, the extension and the header sent by the client are not trusted
+	contentType := http.DetectContentType(data)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	ext, ok := allowedAttachmentTypes[mediaType]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file type not allowed: only images, PDF, ZIP and text files are accepted"})
+		return
+	}
+
+	attachment := models.Attachment{
+		MessageAttachment: models.MessageAttachment{
+			ID:          primitive.NewObjectID(),
+			Name:        attachmentName(fileHeader.Filename),
+			ContentType: contentType,
+		},
+		EventID:    event.ID,
+		UploaderID: userID,
+		CreatedAt:  time.Now(),
+	}
+	original := media.Variant{Data: data, ContentType: contentType, Ext: ext}
+	var thumbnail *media.Variant
+
+	// PNG and JPEG images are re-encoded to strip their metadata, like the images of the gallery
+	if mediaType == "image/png" || mediaType == "image/jpeg" {
+		processed, err := media.ProcessImage(bytes.NewReader(data), media.Limits{
+			MaxBytes:      cfg.ChatAttachmentMaxBytes,
+			MaxDimension:  cfg.MaxImageDimension,
+			ThumbnailSize: cfg.ImageThumbnailSize,
+			WebPSize:      cfg.ImageWebPSize,
+		})
+		if media.IsValidationError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			span.RecordError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process image"})
+			return
+		}
+		original = processed.Original
+		thumbnail = &processed.Thumbnail
+		attachment.ContentType = processed.Original.ContentType
+		attachment.Width = processed.Width
+		attachment.Height = processed.Height
+	}
+	attachment.Size = int64(len(original.Data))
+
+	randomStr, err := generateRandomString(8)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+		return
+	}
+	baseName := fmt.Sprintf("chat/%d/%d-%s", event.ID, time.Now().Unix(), randomStr)
+	attachment.Key = baseName + original.Ext
+	if thumbnail != nil {
+		attachment.ThumbnailKey = baseName + "-thumb" + thumbnail.Ext
+		attachment.ThumbnailSize = int64(len(thumbnail.Data))
+	}
+	span.SetAttributes(attribute.String("file.key", attachment.Key), attribute.Int64("file.size", attachment.Size))
+
+	// The quota counts the files which are not sent yet, they expire after a day.
+	// The attachment is saved first to reserve its place, the client only gets its ID once the files are uploaded.
+	collection := attachmentsCollection(c)
+	reserved, err := reserveChatQuota(ctx, collection, &attachment, cfg.ChatEventQuotaBytes)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the chat quota"})
+		return
+	}
+	if !reserved {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "The storage quota of the event chat is exceeded"})
+		return
+	}
+
+	err = store.Put(ctx, cfg.S3BucketNameChatEvent, attachment.Key, bytes.NewReader(original.Data), original.ContentType)
+	if err == nil && thumbnail != nil {
+		err = store.Put(ctx, cfg.S3BucketNameChatEvent, attachment.ThumbnailKey, bytes.NewReader(thumbnail.Data), thumbnail.ContentType)
+	}
+	if err != nil {
+		span.RecordError(err)
+		// Give back the reservation, the files which were uploaded are removed too
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": attachment.ID}); err != nil {
+			logger.LogMessage("error", fmt.Sprintf("Failed to release the chat quota: %v", err), "", map[string]interface{}{
+				"attachment_id": attachment.ID.Hex(),
+			})
+		}
+		deleteChatFiles(ctx, cfg, store, attachment.Keys()...)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+		return
+	}
+
+	signed := []models.MessageAttachment{attachment.MessageAttachment}
+	if err := signAttachments(ctx, cfg, store, signed); err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+	attachment.MessageAttachment = signed[0]
+
+	c.JSON(http.StatusCreated, attachment)
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// BlockUserHandler adds a user to the block list of the current user
+func BlockUserHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input struct {
+		UserID uint `json:"user_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.UserID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot block yourself"})
+		return
+	}
+
+	var user models.User
+	if err := db.Select("id").First(&user, input.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		}
+		return
+	}
+
+	block := models.UserBlock{UserID: userID, BlockedID: input.UserID}
+	if err := db.Where(&block).FirstOrCreate(&block).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		return
+	}
+	c.JSON(http.StatusCreated, block)
+}
+
+// UnblockUserHandler removes a user from the block list of the current user
+func UnblockUserHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	blockedID, err := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	result := db.Where("user_id = ? AND blocked_id = ?", userID, blockedID).Delete(&models.UserBlock{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unblock user"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not blocked"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked"})
+}
+
+// ListBlocksHandler returns the block list of the current user
+func ListBlocksHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	blocks := []models.UserBlock{}
+	if err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&blocks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve blocked users"})
+		return
+	}
+	c.JSON(http.StatusOK, blocks)
+}
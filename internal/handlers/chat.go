@@ -2,7 +2,6 @@ package handlers
 
 import (
     "context"
-    "encoding/json"
     "log"
     "net/http"
     "strconv"
@@ -10,106 +9,297 @@ import (
 
     jwt "github.com/appleboy/gin-jwt/v2"
     "github.com/gin-gonic/gin"
-    "github.com/gorilla/websocket"
-    "github.com/go-redis/redis/v8"
     "github.com/devops-360-online/go-with-me/config"
     "github.com/devops-360-online/go-with-me/internal/middlewares"
     "github.com/devops-360-online/go-with-me/internal/models"
+    "github.com/devops-360-online/go-with-me/internal/storage"
     "github.com/devops-360-online/go-with-me/internal/websockets"
     "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
     "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "gorm.io/gorm"
 )
 
-var upgrader = websocket.Upgrader{
-    CheckOrigin: func(r *http.Request) bool {
-        return true // Adjust in production
-    },
+// chatMessageInput is a message sent by a client, the attachments were uploaded with UploadAttachmentHandler.
+// Type is empty for a message, typing.start and typing.stop are only broadcast,
+// reaction.add and reaction.remove change the reactions to MessageID, read moves the read marker to MessageID.
+type chatMessageInput struct {
+    Type          string   `json:"type"`
+    Content       string   `json:"content"`
+    AttachmentIDs []string `json:"attachment_ids"`
+    // ReplyTo sends the message in the thread of another message
+    ReplyTo       string   `json:"reply_to"`
+    // ClientID is an idempotency key chosen by the client, a retried message is saved once
+    ClientID      string   `json:"client_id"`
+    MessageID     string   `json:"message_id"`
+    Emoji         string   `json:"emoji"`
+}
+
+// chatHistorySize is the number of messages sent when a socket connects, older ones are paginated with ListMessagesHandler
+const chatHistorySize = 50
+
+// messagesCollection returns the collection of the chat messages
+func messagesCollection(c *gin.Context) *mongo.Collection {
+    cfg := c.MustGet("config").(*config.Config)
+    mongoClient := c.MustGet("mongoClient").(*mongo.Client)
+    return mongoClient.Database(cfg.MongoDatabase).Collection("messages")
+}
+
+// loadChatEvent retrieves the event of the URL when the user takes part in its chat, it writes the error response when it fails
+func loadChatEvent(c *gin.Context, db *gorm.DB, userID uint) (*models.Event, bool) {
+    event, ok := loadVisibleEvent(c, db, userID)
+    if !ok {
+        return nil, false
+    }
+    if event.ChatExpired(c.MustGet("config").(*config.Config).ChatRetention) {
+        c.JSON(http.StatusGone, gin.H{"error": "The chat of this event has expired"})
+        return nil, false
+    }
+    participant, err := isChatParticipant(db, event, userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check event participation"})
+        return nil, false
+    }
+    if !participant {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Only participants can access the chat of this event"})
+        return nil, false
+    }
+    if event.CreatorID != userID {
+        banned, err := isSanctioned(c.Request.Context(), sanctionsCollection(c), event.ID, userID, models.SanctionBan)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check chat sanctions"})
+            return nil, false
+        }
+        if banned {
+            c.JSON(http.StatusForbidden, gin.H{"error": "You are banned from the chat of this event"})
+            return nil, false
+        }
+    }
+    return event, true
+}
+
+// historyFilter matches the messages of the history of the event chat, the replies are in the threads
+func historyFilter(eventID uint) bson.M {
+    return bson.M{"event_id": eventID, "reply_to": bson.M{"$exists": false}}
+}
+
+// findMessages returns at most limit messages of the filter older than before (all when it is zero), oldest first
+func findMessages(ctx context.Context, collection *mongo.Collection, filter bson.M, before primitive.ObjectID, limit int64) ([]models.Message, error) {
+    if !before.IsZero() {
+        filter["_id"] = bson.M{"$lt": before}
+    }
+    cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": -1}).SetLimit(limit))
+    if err != nil {
+        return nil, err
+    }
+    var messages []models.Message
+    if err := cursor.All(ctx, &messages); err != nil {
+        return nil, err
+    }
+    for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+        messages[i], messages[j] = messages[j], messages[i]
+    }
+    return messages, nil
+}
+
+// publishMembership notifies the chat of the event that a user joined or left it,
+// the sockets of a removed user are closed on every replica
+func publishMembership(c *gin.Context, eventID uint, envelopeType string, userID uint) {
+    publishChatEnvelope(c, eventID, envelopeType, websockets.MemberPayload{UserID: userID})
+}
+
+// ListMessagesHandler returns the history of the event chat, newest page first.
+// The next page is requested with the ID of the oldest message in before.
+func ListMessagesHandler(c *gin.Context) {
+    db := c.MustGet("db").(*gorm.DB)
+
+    // Get user ID from JWT
+    claims := jwt.ExtractClaims(c)
+    userID := uint(claims[middlewares.IdentityKey].(float64))
+
+    event, ok := loadChatEvent(c, db, userID)
+    if !ok {
+        return
+    }
+
+    messages, hasMore, ok := findMessagesPage(c, messagesCollection(c), historyFilter(event.ID), userID)
+    if !ok {
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"messages": messages, "has_more": hasMore})
+}
+
+// findMessagesPage returns the page of messages of the filter requested with before and limit, ready to be sent to the user.
+// It writes the error response when it fails.
+func findMessagesPage(c *gin.Context, collection *mongo.Collection, filter bson.M, userID uint) ([]models.Message, bool, bool) {
+    cfg := c.MustGet("config").(*config.Config)
+    store := c.MustGet("storage").(storage.Storage)
+
+    var before primitive.ObjectID
+    if value := c.Query("before"); value != "" {
+        var err error
+        if before, err = primitive.ObjectIDFromHex(value); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+            return nil, false, false
+        }
+    }
+    limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(chatHistorySize)))
+    if limit < 1 || limit > 100 {
+        limit = chatHistorySize
+    }
+
+    // One more message tells whether there is a next page
+    messages, err := findMessages(c.Request.Context(), collection, filter, before, int64(limit)+1)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
+        return nil, false, false
+    }
+    hasMore := len(messages) > limit
+    if hasMore {
+        messages = messages[1:]
+    }
+    if err := prepareMessages(c.Request.Context(), cfg, store, messages, userID); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+        return nil, false, false
+    }
+    if messages == nil {
+        messages = []models.Message{}
+    }
+    return messages, hasMore, true
+}
+
+// prepareMessages signs the attachments of the messages and counts their reactions for the user, 0 for a broadcast
+func prepareMessages(ctx context.Context, cfg *config.Config, store storage.Storage, messages []models.Message, userID uint) error {
+    for i := range messages {
+        if err := signAttachments(ctx, cfg, store, messages[i].Attachments); err != nil {
+            return err
+        }
+        messages[i].CountReactions(userID)
+    }
+    return nil
 }
 
 func EventChatHandler(c *gin.Context) {
-    eventID := c.Param("id")
+    db := c.MustGet("db").(*gorm.DB)
     // Get user ID from JWT
     claims := jwt.ExtractClaims(c)
     userID := uint(claims[middlewares.IdentityKey].(float64))
 
-    conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+    // Only the creator and the participants can connect, before the upgrade so the client gets the HTTP status
+    event, ok := loadChatEvent(c, db, userID)
+    if !ok {
+        return
+    }
+    eventID := event.ID
+
+    // Get configuration from context
+    cfg := c.MustGet("config").(*config.Config)
+
+    conn, err := newUpgrader(cfg).Upgrade(c.Writer, c.Request, nil)
     if err != nil {
         log.Println("Upgrade error:", err)
         return
     }
     defer conn.Close()
 
-    // Get configuration from context
-    cfg := c.MustGet("config").(*config.Config)
+    // Get MongoDB collections from context
+    messageCollection := messagesCollection(c)
+    reads := readsCollection(c)
+    store := c.MustGet("storage").(storage.Storage)
+    chat := newChatService(c)
+    target := eventTarget(event)
 
-    // Get MongoDB client from context
-    mongoClient := c.MustGet("mongoClient").(*mongo.Client)
-    messageCollection := mongoClient.Database(cfg.MongoDatabase).Collection("messages")
+    // Get the websocket hub from context
+    hub := c.MustGet("hub").(*websockets.Hub)
+    presence := c.MustGet("presence").(*websockets.Presence)
 
-    // Get Redis client from context
-    redisClient := c.MustGet("redisClient").(*redis.Client)
+    // Register client in the room of the event, its messages are written by the write pump
+    client := websockets.NewClient(conn, websockets.EventRoom(eventID), userID)
+    // The socket lives as long as the token which opened it
+    if exp, ok := claims["exp"].(float64); ok && exp > 0 {
+        client.ExpireAt(time.Unix(int64(exp), 0))
+    }
+    go client.WritePump()
+    // A reconnecting client gets the envelopes it missed, the others the previous messages
+    history := registerClient(c, hub, client, func(payload *websockets.SystemPayload) (*websockets.Envelope, error) {
+        return websockets.NewEnvelope(websockets.TypeSystem, eventID, payload)
+    })
+    defer hub.Unregister(client)
 
-    // Send previous messages to the client
-    go sendPreviousMessages(eventID, conn, messageCollection)
+    // The user is online in the event until the socket is closed
+    leave := trackPresence(hub, presence, client, eventID)
+    defer leave()
 
-    // Register client in websockets hub
-    client := &websockets.Client{
-        Conn:    conn,
-        EventID: eventID,
+    // Send previous messages to the client
+    if history {
+        go sendPreviousMessages(client, eventID, messageCollection, cfg, store)
     }
-    websockets.RegisterClient(client)
-    defer websockets.UnregisterClient(client)
 
     // Handle incoming messages
     for {
-        var msg models.Message
-        err := conn.ReadJSON(&msg)
+        var input chatMessageInput
+        err := client.ReadJSON(&input)
         if err != nil {
             log.Println("Read error:", err)
             break
         }
-        msg.EventID = parseEventID(eventID)
-        msg.SenderID = userID
-        msg.Timestamp = time.Now()
-
-        // Save message to MongoDB
-        _, err = messageCollection.InsertOne(context.TODO(), msg)
-        if err != nil {
-            log.Println("MongoDB insert error:", err)
+        switch input.Type {
+        case "":
+            if input.Content == "" && len(input.AttachmentIDs) == 0 {
+                continue
+            }
+        case chatActionTypingStart, chatActionTypingStop:
+            // A throttled typing action is dropped, the next one carries the state
+            if refusal, err := chat.guard.throttleSignal(context.TODO(), client.Room(), userID); err != nil || refusal != nil {
+                continue
+            }
+            publishPresence(context.Background(), hub, client.Room(), typingEnvelopeTypes[input.Type], eventID, userID)
+            continue
+        case chatActionRead:
+            refusal, err := chat.guard.throttleSignal(context.TODO(), client.Room(), userID)
+            if err != nil {
+                log.Println("Rate limit error:", err)
+                continue
+            }
+            if refusal != nil {
+                if envelope, err := websockets.NewEnvelope(websockets.TypeSystem, eventID, refusal); err == nil {
+                    client.SendJSON(envelope)
+                }
+                continue
+            }
+            if _, err := readMessage(context.TODO(), hub, messageCollection, reads, eventID, userID, input.MessageID); err != nil {
+                log.Println("Read marker error:", err)
+                client.SendJSON(gin.H{"error": err.Error()})
+            }
+            continue
+        case chatActionReactionAdd, chatActionReactionRemove:
+        default:
+            client.SendJSON(gin.H{"error": "Unknown message type"})
             continue
         }
-
-        // Publish message to Redis
-        msgJSON, _ := json.Marshal(msg)
-        redisClient.Publish(context.Background(), "chat_messages", msgJSON)
+        outcome, err := chat.send(context.TODO(), target, userID, input)
+        target.answer(client, outcome, err)
     }
 }
 
-func sendPreviousMessages(eventID string, conn *websocket.Conn, messageCollection *mongo.Collection) {
+func sendPreviousMessages(client *websockets.Client, eventID uint, messageCollection *mongo.Collection, cfg *config.Config, store storage.Storage) {
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
-    cursor, err := messageCollection.Find(ctx, bson.M{"event_id": parseEventID(eventID)})
+    messages, err := findMessages(ctx, messageCollection, historyFilter(eventID), primitive.NilObjectID, chatHistorySize)
     if err != nil {
         log.Println("MongoDB find error:", err)
         return
     }
-    defer cursor.Close(ctx)
-    for cursor.Next(ctx) {
-        var msg models.Message
-        err := cursor.Decode(&msg)
+    if err := prepareMessages(ctx, cfg, store, messages, client.UserID()); err != nil {
+        log.Println("Attachments signing error:", err)
+    }
+    for _, msg := range messages {
+        envelope, err := websockets.NewEnvelope(websockets.TypeChatMessage, msg.EventID, msg)
         if err != nil {
-            log.Println("Cursor decode error:", err)
+            log.Println("Envelope error:", err)
             continue
         }
-        conn.WriteJSON(msg)
-    }
-}
-
-func parseEventID(eventID string) uint {
-    id, err := strconv.ParseUint(eventID, 10, 64)
-    if err != nil {
-        log.Println("Invalid event ID:", err)
-        return 0 // Handle the error appropriately
+        client.SendJSON(envelope)
     }
-    return uint(id)
 }
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/notifications"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+var (
+	errMuted           = errors.New("you are muted in this chat")
+	errClientIDTooLong = errors.New("the client ID is too long")
+	errClientIDUsed    = errors.New("the client ID is already used by another message")
+	// errDuplicateGone means the insert hit a message with the same client ID which was removed before it could be read back
+	errDuplicateGone = errors.New("the message sent with this client ID is not available anymore")
+	// errConversationUnsupported refuses the features of the event chats in a conversation
+	errConversationUnsupported = errors.New("attachments, reactions and replies are only available in the chats of the events")
+)
+
+// chatService sends the messages and the reactions of the event chats and the messages of the conversations,
+// it is shared by the websocket and the HTTP endpoints
+type chatService struct {
+	db            *gorm.DB
+	cfg           *config.Config
+	store         storage.Storage
+	messages      *mongo.Collection
+	attachments   *mongo.Collection
+	sanctions     *mongo.Collection
+	conversations *mongo.Collection
+	hub           *websockets.Hub
+	presence      *websockets.Presence
+	notifier      *notifications.Notifier
+	guard         *chatGuard
+}
+
+func newChatService(c *gin.Context) *chatService {
+	return &chatService{
+		db:            c.MustGet("db").(*gorm.DB),
+		cfg:           c.MustGet("config").(*config.Config),
+		store:         c.MustGet("storage").(storage.Storage),
+		messages:      messagesCollection(c),
+		attachments:   attachmentsCollection(c),
+		sanctions:     sanctionsCollection(c),
+		conversations: conversationsCollection(c),
+		hub:           c.MustGet("hub").(*websockets.Hub),
+		presence:      c.MustGet("presence").(*websockets.Presence),
+		notifier:      c.MustGet("notifier").(*notifications.Notifier),
+		guard:         newChatGuard(c),
+	}
+}
+
+// chatOutcome is the result of an action sent to the chat service
+type chatOutcome struct {
+	// Message is the saved message, for a duplicate it is the one saved by the first attempt. It is nil for a reaction.
+	Message   *models.Message
+	Duplicate bool
+	// Refusal is the system message explaining why the action was refused
+	Refusal *websockets.SystemPayload
+}
+
+// chatErrorStatus is the HTTP status of an error of the chat service, the errors with a 5xx status are not meant for the user
+func chatErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errMuted), errors.Is(err, errConversationBlocked):
+		return http.StatusForbidden
+	case errors.Is(err, errClientIDUsed), errors.Is(err, errDuplicateGone):
+		return http.StatusConflict
+	case errors.Is(err, errClientIDTooLong), errors.Is(err, errConversationUnsupported), errors.Is(err, errInvalidReplyTo), errors.Is(err, errInvalidAttachments),
+		errors.Is(err, errTooManyAttachments), errors.Is(err, errInvalidReaction), errors.Is(err, errReactionRejected):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// send applies a message or a reaction of the user to the chat, then publishes it to the room of the chat.
+// The conversations only accept the messages without attachments or reply.
+func (s *chatService) send(ctx context.Context, target chatTarget, userID uint, input chatMessageInput) (*chatOutcome, error) {
+	if target.conversation != nil {
+		if input.Type != "" || len(input.AttachmentIDs) > 0 || input.ReplyTo != "" {
+			return nil, errConversationUnsupported
+		}
+		// A block can start while the socket is open
+		if err := canSendToConversation(s.db, target.conversation, userID); err != nil {
+			return nil, err
+		}
+	} else {
+		// The chat can expire while a client is connected, the sweeper removes its messages
+		if target.event.ChatExpired(s.cfg.ChatRetention) {
+			return &chatOutcome{Refusal: &websockets.SystemPayload{
+				Code:    systemChatExpired,
+				Message: "The chat of this event has expired",
+			}}, nil
+		}
+		// A mute can start or end while the socket is open
+		muted, err := isSanctioned(ctx, s.sanctions, target.event.ID, userID, models.SanctionMute)
+		if err != nil {
+			return nil, err
+		}
+		if muted {
+			return nil, errMuted
+		}
+	}
+
+	// A message sent again by the client is answered with the saved one, the reactions are idempotent already
+	if input.Type == "" {
+		if outcome, err := s.findDuplicate(ctx, target, userID, input.ClientID); outcome != nil || err != nil {
+			return outcome, err
+		}
+	}
+
+	// The messages and the reactions share the rate limit of the user in the room, it lets everything through when Redis fails
+	room := target.room()
+	refusal, err := s.guard.throttle(ctx, room, userID)
+	if err != nil {
+		log.Println("Rate limit error:", err)
+	}
+	if refusal == nil && input.Type == "" {
+		if refusal, err = s.guard.checkContent(input.Content); err != nil {
+			return nil, err
+		}
+	}
+	if refusal != nil {
+		return &chatOutcome{Refusal: refusal}, nil
+	}
+	if input.Type != "" {
+		return &chatOutcome{}, applyReaction(ctx, s.messages, s.hub, room, target.event.ID, userID, input)
+	}
+
+	msg := models.Message{
+		ID:        primitive.NewObjectID(),
+		SenderID:  userID,
+		ClientID:  input.ClientID,
+		Content:   input.Content,
+		Timestamp: time.Now(),
+	}
+	if target.conversation != nil {
+		msg.ConversationID = &target.conversation.ID
+	} else {
+		msg.EventID = target.event.ID
+	}
+
+	// A reply joins the thread of the message it answers
+	if input.ReplyTo != "" {
+		msg.ReplyTo, err = findThreadRoot(ctx, s.messages, msg.EventID, input.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The mentions are resolved to the members of the chat
+	mentioned, err := resolveMentions(s.db, target, msg.Content)
+	if err != nil {
+		log.Println("Mentions error:", err)
+	}
+	msg.Mentions = userIDs(mentioned)
+
+	// The attachments are claimed before the message is saved so they cannot be sent twice
+	msg.Attachments, err = claimAttachments(ctx, s.attachments, msg.EventID, userID, input.AttachmentIDs, msg.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save message to MongoDB
+	if _, err := s.messages.InsertOne(ctx, msg); err != nil {
+		releaseAttachments(ctx, s.attachments, msg.ID)
+		// A duplicate client ID is a retry racing with the first attempt, which is published
+		if mongo.IsDuplicateKeyError(err) {
+			outcome, err := s.findDuplicate(ctx, target, userID, input.ClientID)
+			if err == nil && outcome == nil {
+				err = errDuplicateGone
+			}
+			return outcome, err
+		}
+		return nil, err
+	}
+	if msg.ReplyTo != nil {
+		if err := countReply(ctx, s.messages, *msg.ReplyTo, msg.Timestamp); err != nil {
+			log.Println("MongoDB thread update error:", err)
+		}
+	}
+	// The conversations are listed by last activity
+	if target.conversation != nil {
+		if _, err := s.conversations.UpdateOne(ctx, bson.M{"_id": target.conversation.ID},
+			bson.M{"$max": bson.M{"last_message_at": msg.Timestamp}}); err != nil {
+			log.Println("MongoDB conversation update error:", err)
+		}
+	}
+
+	// The receivers get the metadata of the attachments with signed URLs
+	if err := signAttachments(ctx, s.cfg, s.store, msg.Attachments); err != nil {
+		log.Println("Attachments signing error:", err)
+	}
+
+	// Publish message to the sockets of the chat on every replica
+	envelope, err := target.envelope(websockets.TypeChatMessage, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.hub.Publish(context.Background(), room, envelope); err != nil {
+		log.Println("Redis publish error:", err)
+	}
+
+	// The mentions are notified off the read loop of the sender, one email is published by offline user
+	notifyMentionsAsync(s.notifier, s.presence, target, msg, mentioned)
+
+	// The unread counts only cover the history of the events, the replies stay in their thread
+	if target.event != nil && msg.ReplyTo == nil {
+		if err := notifyUnread(context.Background(), s.db, s.hub, target.event, &msg); err != nil {
+			log.Println("Unread notification error:", err)
+		}
+	}
+	return &chatOutcome{Message: &msg}, nil
+}
+
+// findDuplicate returns the message the user already sent in the chat with the client ID, nil when it is a new one
+func (s *chatService) findDuplicate(ctx context.Context, target chatTarget, userID uint, clientID string) (*chatOutcome, error) {
+	if len(clientID) > maxClientIDLength {
+		return nil, errClientIDTooLong
+	}
+	sent, err := findSentMessage(ctx, s.messages, userID, clientID)
+	if err != nil || sent == nil {
+		return nil, err
+	}
+	if !target.holds(sent) {
+		return nil, errClientIDUsed
+	}
+	messages := []models.Message{*sent}
+	if err := prepareMessages(ctx, s.cfg, s.store, messages, userID); err != nil {
+		log.Println("Attachments signing error:", err)
+	}
+	return &chatOutcome{Message: &messages[0], Duplicate: true}, nil
+}
+
+// answer sends the outcome of an action received on the socket of the chat to its sender, the room got the new messages
+func (t chatTarget) answer(client *websockets.Client, outcome *chatOutcome, err error) {
+	if err != nil {
+		log.Println("Chat error:", err)
+		if chatErrorStatus(err) < http.StatusInternalServerError {
+			client.SendJSON(gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if outcome == nil {
+		return
+	}
+	if outcome.Refusal != nil {
+		if envelope, err := t.envelope(websockets.TypeSystem, outcome.Refusal); err == nil {
+			client.SendJSON(envelope)
+		}
+		return
+	}
+	// The others got the message when it was first sent
+	if outcome.Duplicate {
+		if envelope, err := t.envelope(websockets.TypeChatMessage, outcome.Message); err == nil {
+			client.SendJSON(envelope)
+		}
+	}
+}
+
+// writeChatOutcome writes the response of an action sent over HTTP: the message with 201, or with 200 when it was
+// already sent with the same client_id, and the status of the refusals and of the errors
+func writeChatOutcome(c *gin.Context, outcome *chatOutcome, err error) {
+	if err != nil {
+		if status := chatErrorStatus(err); status < http.StatusInternalServerError {
+			c.JSON(status, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		}
+		return
+	}
+	if outcome == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		return
+	}
+	if outcome.Refusal != nil {
+		if outcome.Refusal.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.FormatInt((outcome.Refusal.RetryAfter+999)/1000, 10))
+		}
+		c.JSON(refusedStatus(outcome.Refusal), gin.H{"error": outcome.Refusal.Message, "code": outcome.Refusal.Code})
+		return
+	}
+	if outcome.Message == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	if outcome.Duplicate {
+		c.JSON(http.StatusOK, outcome.Message)
+		return
+	}
+	c.JSON(http.StatusCreated, outcome.Message)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"gorm.io/gorm"
+)
+
+// chatTarget is the chat a message is sent to, the chat of an event or a conversation between users
+type chatTarget struct {
+	event        *models.Event
+	conversation *models.Conversation
+}
+
+func eventTarget(event *models.Event) chatTarget {
+	return chatTarget{event: event}
+}
+
+func conversationTarget(conversation *models.Conversation) chatTarget {
+	return chatTarget{conversation: conversation}
+}
+
+// room is the room of the sockets connected to the chat
+func (t chatTarget) room() string {
+	if t.conversation != nil {
+		return websockets.ConversationRoom(t.conversation.ID.Hex())
+	}
+	return websockets.EventRoom(t.event.ID)
+}
+
+// envelope encodes the payload in an envelope of the given type for the chat
+func (t chatTarget) envelope(envelopeType string, payload interface{}) (*websockets.Envelope, error) {
+	if t.conversation != nil {
+		return websockets.NewConversationEnvelope(envelopeType, t.conversation.ID.Hex(), payload)
+	}
+	return websockets.NewEnvelope(envelopeType, t.event.ID, payload)
+}
+
+// holds reports whether the message was sent to the chat
+func (t chatTarget) holds(msg *models.Message) bool {
+	if t.conversation != nil {
+		return msg.ConversationID != nil && *msg.ConversationID == t.conversation.ID
+	}
+	return msg.ConversationID == nil && msg.EventID == t.event.ID
+}
+
+// memberIDs returns the users who read the chat
+func (t chatTarget) memberIDs(db *gorm.DB) ([]uint, error) {
+	if t.conversation != nil {
+		return t.conversation.MemberIDs, nil
+	}
+	return chatMemberIDs(db, t.event)
+}
+
+// title names the chat in the emails
+func (t chatTarget) title() string {
+	switch {
+	case t.conversation == nil:
+		return fmt.Sprintf("the chat of %s", t.event.Name)
+	case t.conversation.Name != "":
+		return t.conversation.Name
+	default:
+		return "a conversation"
+	}
+}
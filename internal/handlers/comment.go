@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func CreateCommentHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	eventID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	var input struct {
+		Content  string `json:"content" binding:"required"`
+		ParentID *uint  `json:"parent_id"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	content := strings.TrimSpace(input.Content)
+	if content == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Comment cannot be empty"})
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	// Check if the event exists and is visible to the user
+	if _, ok := loadVisibleEvent(c, db, userID); !ok {
+		return
+	}
+
+	// A reply must belong to the same event as its parent
+	if input.ParentID != nil {
+		var parent models.Comment
+		if err := db.Where("id = ? AND event_id = ?", *input.ParentID, eventID).First(&parent).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Parent comment not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve parent comment"})
+			}
+			return
+		}
+	}
+
+	comment := models.Comment{
+		EventID:  uint(eventID),
+		UserID:   userID,
+		ParentID: input.ParentID,
+		Content:  content,
+	}
+	if err := db.Create(&comment).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create comment"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, comment)
+}
+
+func ListCommentsHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadVisibleEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	// Get pagination parameters from query, pagination applies to the top level comments
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 10
+	}
+
+	var comments []models.Comment
+	if err := db.Where("event_id = ?", event.ID).Order("created_at ASC").Find(&comments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve comments"})
+		return
+	}
+
+	threads := models.BuildCommentThreads(comments)
+	start := (page - 1) * pageSize
+	if start > len(threads) {
+		start = len(threads)
+	}
+	end := start + pageSize
+	if end > len(threads) {
+		end = len(threads)
+	}
+
+	c.JSON(http.StatusOK, threads[start:end])
+}
+
+func DeleteCommentHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	eventID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	commentID, err := strconv.ParseUint(c.Param("commentId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var event models.Event
+	if err := db.First(&event, eventID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
+		}
+		return
+	}
+
+	var comment models.Comment
+	if err := db.Where("id = ? AND event_id = ?", commentID, eventID).First(&comment).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve comment"})
+		}
+		return
+	}
+
+	// Only the author or the event creator can delete a comment
+	if comment.UserID != userID && event.CreatorID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to delete this comment"})
+		return
+	}
+
+	// Replies are deleted together with their parent
+	err = db.Transaction(func(tx *gorm.DB) error {
+		ids := []uint{comment.ID}
+		for pending := ids; len(pending) > 0; {
+			var children []uint
+			if err := tx.Model(&models.Comment{}).Where("parent_id IN ?", pending).Pluck("id", &children).Error; err != nil {
+				return err
+			}
+			ids = append(ids, children...)
+			pending = children
+		}
+		return tx.Delete(&models.Comment{}, ids).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete comment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Comment deleted"})
+}
@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+var errConversationBlocked = errors.New("you cannot send messages in this conversation")
+
+// conversationsCollection returns the collection of the conversations between users
+func conversationsCollection(c *gin.Context) *mongo.Collection {
+	cfg := c.MustGet("config").(*config.Config)
+	mongoClient := c.MustGet("mongoClient").(*mongo.Client)
+	return mongoClient.Database(cfg.MongoDatabase).Collection("conversations")
+}
+
+// conversationFilter matches the messages of the conversation
+func conversationFilter(conversationID primitive.ObjectID) bson.M {
+	return bson.M{"conversation_id": conversationID}
+}
+
+// loadConversation retrieves the conversation of the URL when the user is a member, it writes the error response when it fails.
+// The conversations of the others are reported as not found.
+func loadConversation(c *gin.Context, userID uint) (*models.Conversation, bool) {
+	conversationID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+		return nil, false
+	}
+	var conversation models.Conversation
+	err = conversationsCollection(c).FindOne(c.Request.Context(), bson.M{"_id": conversationID, "member_ids": userID}).Decode(&conversation)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversation"})
+		}
+		return nil, false
+	}
+	return &conversation, true
+}
+
+// blockedAmong reports whether the user blocked one of the others or was blocked by one of them
+func blockedAmong(db *gorm.DB, userID uint, otherIDs []uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.UserBlock{}).
+		Where("(user_id = ? AND blocked_id IN ?) OR (user_id IN ? AND blocked_id = ?)", userID, otherIDs, otherIDs, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// blockedBetween reports whether one of the users blocked another one of them
+func blockedBetween(db *gorm.DB, userIDs []uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.UserBlock{}).Where("user_id IN ? AND blocked_id IN ?", userIDs, userIDs).Count(&count).Error
+	return count > 0, err
+}
+
+// canSendToConversation checks the block list between the sender and the other members. A block made after
+// the creation of a group stops the messages of the sender, the room is shared so they cannot skip a member.
+func canSendToConversation(db *gorm.DB, conversation *models.Conversation, userID uint) error {
+	var otherIDs []uint
+	for _, id := range conversation.MemberIDs {
+		if id != userID {
+			otherIDs = append(otherIDs, id)
+		}
+	}
+	if len(otherIDs) == 0 {
+		return nil
+	}
+	blocked, err := blockedAmong(db, userID, otherIDs)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errConversationBlocked
+	}
+	return nil
+}
+
+// CreateConversationHandler starts a conversation with other users. A single user makes a direct conversation,
+// which is returned when it already exists, several users make a group.
+func CreateConversationHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input struct {
+		UserIDs []uint `json:"user_ids" binding:"required,min=1"`
+		Name    string `json:"name" binding:"max=100"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	seen := map[uint]bool{userID: true}
+	var otherIDs []uint
+	for _, id := range input.UserIDs {
+		if !seen[id] {
+			seen[id] = true
+			otherIDs = append(otherIDs, id)
+		}
+	}
+	if len(otherIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A conversation needs another user"})
+		return
+	}
+	if len(otherIDs)+1 > models.MaxConversationMembers {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A conversation has at most " + strconv.Itoa(models.MaxConversationMembers) + " members"})
+		return
+	}
+
+	var count int64
+	if err := db.Model(&models.User{}).Where("id IN ?", otherIDs).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
+		return
+	}
+	if int(count) != len(otherIDs) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	// The members of a group must not have blocked each other either, not only the creator
+	blocked, err := blockedBetween(db, append([]uint{userID}, otherIDs...))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check blocked users"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot start a conversation between users who blocked each other"})
+		return
+	}
+
+	now := time.Now()
+	conversation := models.Conversation{
+		ID:            primitive.NewObjectID(),
+		Type:          models.ConversationGroup,
+		Name:          input.Name,
+		CreatorID:     userID,
+		MemberIDs:     append([]uint{userID}, otherIDs...),
+		CreatedAt:     now,
+		LastMessageAt: now,
+	}
+	collection := conversationsCollection(c)
+	if len(otherIDs) == 1 {
+		conversation.Type = models.ConversationDirect
+		conversation.Name = ""
+		conversation.DirectKey = models.DirectConversationKey(userID, otherIDs[0])
+	}
+
+	if _, err := collection.InsertOne(c.Request.Context(), conversation); err != nil {
+		if conversation.Type != models.ConversationDirect || !mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+			return
+		}
+		// The two users already talk to each other
+		if err := collection.FindOne(c.Request.Context(), bson.M{"direct_key": conversation.DirectKey}).Decode(&conversation); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversation"})
+			return
+		}
+		c.JSON(http.StatusOK, conversation)
+		return
+	}
+	c.JSON(http.StatusCreated, conversation)
+}
+
+// ListConversationsHandler returns the conversations of the user, the most recently active first.
+// The next page is requested with the last_message_at of the last conversation in before.
+func ListConversationsHandler(c *gin.Context) {
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	filter := bson.M{"member_ids": userID}
+	if value := c.Query("before"); value != "" {
+		before, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before date, use RFC 3339"})
+			return
+		}
+		filter["last_message_at"] = bson.M{"$lt": before}
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(chatHistorySize)))
+	if limit < 1 || limit > 100 {
+		limit = chatHistorySize
+	}
+
+	// One more conversation tells whether there is a next page
+	cursor, err := conversationsCollection(c).Find(c.Request.Context(), filter,
+		options.Find().SetSort(bson.M{"last_message_at": -1}).SetLimit(int64(limit)+1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversations"})
+		return
+	}
+	conversations := []models.Conversation{}
+	if err := cursor.All(c.Request.Context(), &conversations); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversations"})
+		return
+	}
+	hasMore := len(conversations) > limit
+	if hasMore {
+		conversations = conversations[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"conversations": conversations, "has_more": hasMore})
+}
+
+// ListConversationMessagesHandler returns the history of a conversation, paginated like the chat of the events
+func ListConversationMessagesHandler(c *gin.Context) {
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+	messages, hasMore, ok := findMessagesPage(c, messagesCollection(c), conversationFilter(conversation.ID), userID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages, "has_more": hasMore})
+}
+
+// ConversationChatHandler opens the socket of a conversation, it accepts the messages and the typing actions of the event chat.
+// The attachments, the reactions and the threads are only available in the chats of the events.
+func ConversationChatHandler(c *gin.Context) {
+	cfg := c.MustGet("config").(*config.Config)
+	hub := c.MustGet("hub").(*websockets.Hub)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	// Only the members can connect, before the upgrade so the client gets the HTTP status
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+	conversationID := conversation.ID.Hex()
+
+	conn, err := newUpgrader(cfg).Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+
+	messageCollection := messagesCollection(c)
+	chat := newChatService(c)
+	target := conversationTarget(conversation)
+
+	client := websockets.NewClient(conn, websockets.ConversationRoom(conversationID), userID)
+	// The socket lives as long as the token which opened it
+	if exp, ok := claims["exp"].(float64); ok && exp > 0 {
+		client.ExpireAt(time.Unix(int64(exp), 0))
+	}
+	go client.WritePump()
+	// A reconnecting client gets the envelopes it missed, the others the previous messages
+	history := registerClient(c, hub, client, func(payload *websockets.SystemPayload) (*websockets.Envelope, error) {
+		return target.envelope(websockets.TypeSystem, payload)
+	})
+	defer hub.Unregister(client)
+
+	if history {
+		go sendConversationHistory(client, conversation.ID, messageCollection)
+	}
+
+	for {
+		var input chatMessageInput
+		if err := client.ReadJSON(&input); err != nil {
+			log.Println("Read error:", err)
+			break
+		}
+		switch input.Type {
+		case "":
+		case chatActionTypingStart, chatActionTypingStop:
+			// A throttled typing action is dropped, the next one carries the state
+			if refusal, err := chat.guard.throttleSignal(context.TODO(), client.Room(), userID); err != nil || refusal != nil {
+				continue
+			}
+			envelope, err := target.envelope(typingEnvelopeTypes[input.Type], websockets.PresencePayload{UserID: userID})
+			if err == nil {
+				err = hub.Publish(context.Background(), client.Room(), envelope)
+			}
+			if err != nil {
+				log.Println("Redis publish error:", err)
+			}
+			continue
+		default:
+			client.SendJSON(gin.H{"error": "Unknown message type"})
+			continue
+		}
+		if input.Content == "" && len(input.AttachmentIDs) == 0 && input.ReplyTo == "" {
+			continue
+		}
+
+		outcome, err := chat.send(context.TODO(), target, userID, input)
+		target.answer(client, outcome, err)
+	}
+}
+
+// ConversationStreamHandler delivers the envelopes of a conversation as server-sent events like EventStreamHandler,
+// the messages are sent with SendConversationMessageHandler
+func ConversationStreamHandler(c *gin.Context) {
+	hub := c.MustGet("hub").(*websockets.Hub)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+	target := conversationTarget(conversation)
+
+	client := websockets.NewStreamClient(target.room(), userID)
+	serveEventStream(c, hub, client, func() func() {
+		// A reconnecting client gets the envelopes it missed, the others the previous messages
+		history := registerClient(c, hub, client, func(payload *websockets.SystemPayload) (*websockets.Envelope, error) {
+			return target.envelope(websockets.TypeSystem, payload)
+		})
+		if history {
+			go sendConversationHistory(client, conversation.ID, messagesCollection(c))
+		}
+		return func() {}
+	})
+}
+
+// SendConversationMessageHandler sends a message to a conversation over HTTP, the body is the one of the websocket messages.
+// The message is returned with 201, or with 200 when it was already sent with the same client_id.
+func SendConversationMessageHandler(c *gin.Context) {
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input chatMessageInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Type != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown message type"})
+		return
+	}
+	if input.Content == "" && len(input.AttachmentIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The message is empty"})
+		return
+	}
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+
+	outcome, err := newChatService(c).send(c.Request.Context(), conversationTarget(conversation), userID, input)
+	writeChatOutcome(c, outcome, err)
+}
+
+func sendConversationHistory(client *websockets.Client, conversationID primitive.ObjectID, messageCollection *mongo.Collection) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	messages, err := findMessages(ctx, messageCollection, conversationFilter(conversationID), primitive.NilObjectID, chatHistorySize)
+	if err != nil {
+		log.Println("MongoDB find error:", err)
+		return
+	}
+	for _, msg := range messages {
+		envelope, err := websockets.NewConversationEnvelope(websockets.TypeChatMessage, conversationID.Hex(), msg)
+		if err != nil {
+			log.Println("Envelope error:", err)
+			continue
+		}
+		client.SendJSON(envelope)
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxClientIDLength bounds the idempotency keys of the messages, a UUID fits
+const maxClientIDLength = 64
+
+// systemResumeUnavailable tells a reconnecting client that the missed envelopes are lost and the history is sent again
+const systemResumeUnavailable = "resume_unavailable"
+
+// registerClient registers the client in the hub and reports whether it needs the history of the room.
+// A client which reconnects sends the ID of the last envelope it received in last_id, or in the Last-Event-ID header
+// of the event streams, and gets the ones it missed instead.
+// When they are not available anymore it gets a resume_unavailable system message followed by the history.
+// The write pump of the client must be running.
+func registerClient(c *gin.Context, hub *websockets.Hub, client *websockets.Client, system func(*websockets.SystemPayload) (*websockets.Envelope, error)) bool {
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_id")
+	}
+	if lastID == "" {
+		hub.Register(client)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := hub.Resume(ctx, client, lastID)
+	if err == nil {
+		return false
+	}
+	if !errors.Is(err, websockets.ErrResumeUnavailable) {
+		log.Println("Resume error:", err)
+	}
+	envelope, err := system(&websockets.SystemPayload{
+		Code:    systemResumeUnavailable,
+		Message: "The missed messages are not available anymore, the history is sent again",
+	})
+	if err == nil {
+		client.SendJSON(envelope)
+	}
+	return true
+}
+
+// findSentMessage returns the message the user already sent with the client ID, nil when it is a new one
+func findSentMessage(ctx context.Context, collection *mongo.Collection, userID uint, clientID string) (*models.Message, error) {
+	if clientID == "" {
+		return nil, nil
+	}
+	var msg models.Message
+	err := collection.FindOne(ctx, bson.M{"sender_id": userID, "client_id": clientID}).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -1,27 +1,27 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/devops-360-online/go-with-me/config"
 	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/media"
 	"github.com/devops-360-online/go-with-me/internal/middlewares"
 	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -39,47 +39,95 @@ func generateRandomString(n int) (string, error) {
 
 func ListEventsHandler(c *gin.Context) {
 	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
 
 	// Get pagination parameters from query
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
 
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
 	var events []models.Event
-	if err := db.Preload("Users").Offset((page - 1) * pageSize).Limit(pageSize).Find(&events).Error; err != nil {
+	if err := db.Scopes(models.VisibleEvents(userID)).Preload("Users").Offset((page - 1) * pageSize).Limit(pageSize).Find(&events).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve events"})
 		return
 	}
 
+	for i := range events {
+		hideInviteCode(&events[i], userID)
+		if err := signEventMedia(c.Request.Context(), cfg, store, &events[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+			return
+		}
+	}
+
 	c.JSON(http.StatusOK, events)
 }
 
+// hideInviteCode removes the invite code of a private event for everyone but its creator
+func hideInviteCode(event *models.Event, userID uint) {
+	if event.CreatorID != userID {
+		event.InviteCode = ""
+	}
+}
+
 func GetEventHandler(c *gin.Context) {
 	db := c.MustGet("db").(*gorm.DB)
-	eventIDParam := c.Param("id")
-	eventID, err := strconv.ParseUint(eventIDParam, 10, 64)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	visible, ok := loadVisibleEvent(c, db, userID)
+	if !ok {
 		return
 	}
 
 	var event models.Event
-	if err := db.Preload("Users").First(&event, eventID).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
-		}
+	err := db.Preload("Users").
+		Preload("Images", func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("status = ?", models.ImageStatusApproved).Order("position ASC")
+		}).
+		First(&event, visible.ID).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
+		return
+	}
+	hideInviteCode(&event, userID)
+	if err := signEventMedia(c.Request.Context(), cfg, store, &event); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
 		return
 	}
 
+	// Attach the aggregate rating of the event
+	rating, err := models.GetEventRating(db, event.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve rating"})
+		return
+	}
+	event.Rating = &rating
+
 	c.JSON(http.StatusOK, event)
 }
 
-// UploadFileToS3 uploads a file to S3 (or LocalStack in your case)
-func UploadFileToS3(ctx context.Context, cfg *config.Config, file multipart.File, fileHeader *multipart.FileHeader, eventID uint, eventName string) (string, error) {
-	tracer := otel.Tracer("event-service")           // Get the tracer
-	ctx, span := tracer.Start(ctx, "UploadFileToS3") // Start a new span for the S3 upload process
-	defer span.End()                                 // End the span when the function completes
+// UploadedImage holds the storage keys of an uploaded image and of its variants
+type UploadedImage struct {
+	Key          string
+	ThumbnailKey string
+	WebPKey      string
+}
+
+// UploadEventImage processes an uploaded image (type sniffing, size limits, metadata removal, variants)
+// and stores it with its thumbnail and WebP variants in the events bucket
+func UploadEventImage(ctx context.Context, cfg *config.Config, store storage.Storage, file multipart.File, fileHeader *multipart.FileHeader, eventID uint, eventName string) (*UploadedImage, error) {
+	tracer := otel.Tracer("event-service")             // Get the tracer
+	ctx, span := tracer.Start(ctx, "UploadEventImage") // Start a new span for the upload process
+	defer span.End()                                   // End the span when the function completes
 
 	// Log the event and file details for tracing
 	span.SetAttributes(
@@ -87,74 +135,103 @@ func UploadFileToS3(ctx context.Context, cfg *config.Config, file multipart.File
 		attribute.String("file.original_name", fileHeader.Filename),
 		attribute.Int("event.id", int(eventID)),
 	)
+	return storeEventImage(ctx, cfg, store, file, eventID, eventName)
+}
 
-	// Get the S3 endpoint from the environment (default to LocalStack if available)
-	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
-	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
-		span.RecordError(fmt.Errorf("file type not allowed")) // Record error in the trace
-		return "", errors.New("file type not allowed: only PNG, JPEG files are accepted")
-	}
-
-	// Trace session creation
-	_, sessSpan := tracer.Start(ctx, "CreateS3Session") // Start a span for session creation
-	sess, err := session.NewSession(&aws.Config{
-		Region:           aws.String(cfg.S3Region),
-		Credentials:      credentials.NewStaticCredentials(cfg.AwsAccessKeyID, cfg.AwsSecretAccessKey, ""),
-		Endpoint:         aws.String(cfg.S3Endpoint), // Use the custom endpoint for LocalStack or AWS
-		S3ForcePathStyle: aws.Bool(true),             // Force path-style URLs for LocalStack compatibility
+// storeEventImage runs the image pipeline on the content of an upload and stores the image
+// with its variants in the events bucket, the files of the direct uploads go through it too
+func storeEventImage(ctx context.Context, cfg *config.Config, store storage.Storage, r io.Reader, eventID uint, eventName string) (*UploadedImage, error) {
+	tracer := otel.Tracer("event-service")
+	ctx, span := tracer.Start(ctx, "StoreEventImage")
+	defer span.End()
+
+	// Check the content of the file and generate the variants
+	_, processSpan := tracer.Start(ctx, "ProcessImage")
+	processed, err := media.ProcessImage(r, media.Limits{
+		MaxBytes:      cfg.MaxUploadBytes,
+		MaxDimension:  cfg.MaxImageDimension,
+		ThumbnailSize: cfg.ImageThumbnailSize,
+		WebPSize:      cfg.ImageWebPSize,
 	})
 	if err != nil {
-		sessSpan.RecordError(err) // Record error in trace
-		sessSpan.End()            // End span
-		return "", err
+		processSpan.RecordError(err) // Record error in the trace
+		processSpan.End()
+		return nil, err
 	}
-	sessSpan.End() // End the span for session creation
-
-	// Create a new S3 client
-	s3Client := s3.New(sess)
+	processSpan.SetAttributes(
+		attribute.Int("image.width", processed.Width),
+		attribute.Int("image.height", processed.Height),
+	)
+	processSpan.End()
 
-	// Clean the event name by removing spaces or special characters for use in the S3 key
+	// Clean the event name by removing spaces or special characters for use in the key
 	cleanedEventName := strings.ReplaceAll(strings.ToLower(eventName), " ", "-")
 
 	// Generate a random string for uniqueness
 	randomStr, err := generateRandomString(8) // 8-byte random string (16 characters hex)
 	if err != nil {
 		span.RecordError(err) // Record error in the trace
-		return "", err
+		return nil, err
 	}
 
-	// Generate a unique S3 key (path) using the event name, event ID, and random string
-	fileName := fmt.Sprintf("events/%s-%d/%d-%s-%s%s", cleanedEventName, eventID, time.Now().Unix(), randomStr, fileHeader.Filename, ext)
-	span.SetAttributes(attribute.String("file.s3_key", fileName)) // Add S3 key to the trace
-
-	// Upload file to S3 and trace the process
-	_, uploadSpan := tracer.Start(ctx, "UploadFileToS3") // Start a span for file upload
-	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(cfg.S3BucketNameEvents),
-		Key:    aws.String(fileName), // The key includes the folder path for the event
-		Body:   file,
-		ACL:    aws.String("public-read"), // Make the file publicly readable
-	})
-	if err != nil {
-		uploadSpan.RecordError(err) // Record error in the trace
-		uploadSpan.End()            // End the upload span
-		return "", err
+	// Generate unique keys (path) using the event name, event ID, and random string
+	baseName := fmt.Sprintf("events/%s-%d/%d-%s", cleanedEventName, eventID, time.Now().Unix(), randomStr)
+	uploaded := &UploadedImage{
+		Key:          baseName + processed.Original.Ext,
+		ThumbnailKey: baseName + "-thumb" + processed.Thumbnail.Ext,
+		WebPKey:      baseName + processed.WebP.Ext,
+	}
+	span.SetAttributes(attribute.String("file.key", uploaded.Key)) // Add the key to the trace
+
+	variants := []struct {
+		key     string
+		variant media.Variant
+	}{
+		{uploaded.Key, processed.Original},
+		{uploaded.ThumbnailKey, processed.Thumbnail},
+		{uploaded.WebPKey, processed.WebP},
+	}
+	for i, v := range variants {
+		// Upload the file and trace the process
+		_, uploadSpan := tracer.Start(ctx, "PutObject") // Start a span for file upload
+		uploadSpan.SetAttributes(attribute.String("file.key", v.key))
+		err = store.Put(ctx, cfg.S3BucketNameEvents, v.key, bytes.NewReader(v.variant.Data), v.variant.ContentType)
+		if err != nil {
+			uploadSpan.RecordError(err) // Record error in the trace
+			uploadSpan.End()            // End the upload span
+			// Do not leave the variants uploaded so far behind
+			for _, previous := range variants[:i] {
+				DeleteEventFile(ctx, cfg, store, previous.key)
+			}
+			return nil, err
+		}
+		uploadSpan.End() // End the span for the upload operation
 	}
-	uploadSpan.End() // End the span for the upload operation
 
-	// Generate dynamic file URL based on whether you're using LocalStack or AWS
-	var fileURL string
-	if cfg.S3Endpoint != "" {
-		// For LocalStack, generate the URL using localhost and bucket name in the path
-		fileURL = fmt.Sprintf("http://localhost:4566/%s/%s", cfg.S3BucketNameEvents, fileName)
-		span.SetAttributes(attribute.String("file.localstack_url", fileURL)) // Add the file URL to the trace
-	} else {
-		// For AWS, use the standard S3 URL format
-		fileURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.S3BucketNameEvents, cfg.S3Region, fileName)
-		span.SetAttributes(attribute.String("file.aws_url", fileURL)) // Add the file URL to the trace
+	return uploaded, nil
+}
+
+// DeleteEventFile removes an uploaded file from the events bucket
+func DeleteEventFile(ctx context.Context, cfg *config.Config, store storage.Storage, key string) error {
+	tracer := otel.Tracer("event-service")
+	ctx, span := tracer.Start(ctx, "DeleteEventFile")
+	defer span.End()
+	span.SetAttributes(attribute.String("file.key", key))
+
+	if err := store.Delete(ctx, cfg.S3BucketNameEvents, key); err != nil {
+		span.RecordError(err)
+		return err
 	}
+	return nil
+}
 
-	return fileURL, nil
+// parseEventDate parses the full RFC3339 format first, then the date only (YYYY-MM-DD)
+func parseEventDate(value string) (time.Time, error) {
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		date, err = time.Parse("2006-01-02", value)
+	}
+	return date, err
 }
 
 func CreateEventHandler(c *gin.Context) {
@@ -188,16 +265,11 @@ func CreateEventHandler(c *gin.Context) {
 		return
 	}
 
-	// Try to parse the full RFC3339 format first, fallback to date-only format
-	eventDate, err := time.Parse(time.RFC3339, dateStr)
+	eventDate, err := parseEventDate(dateStr)
 	if err != nil {
-		// Fallback to parsing just the date (YYYY-MM-DD)
-		eventDate, err = time.Parse("2006-01-02", dateStr)
-		if err != nil {
-			span.RecordError(err) // Trace the error
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Expected formats: YYYY-MM-DD or RFC3339"})
-			return
-		}
+		span.RecordError(err) // Trace the error
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Expected formats: YYYY-MM-DD or RFC3339"})
+		return
 	}
 	event.Date = eventDate
 
@@ -208,28 +280,59 @@ func CreateEventHandler(c *gin.Context) {
 	event.CreatedAt = time.Now()
 	event.UpdatedAt = time.Now()
 
-	// Handle the file upload
-	file, fileHeader, err := c.Request.FormFile("file")
-	if err != nil && err != http.ErrMissingFile {
+	// Private events can only be joined with their invite code
+	if private, _ := strconv.ParseBool(c.PostForm("private")); private {
+		event.Private = true
+		event.InviteCode, err = generateRandomString(16)
+		if err != nil {
+			span.RecordError(err) // Trace the error
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create event"})
+			return
+		}
+	}
+
+	// The chat is kept for the configured retention after the event unless the creator chooses another one, 0 keeps it forever
+	if value := c.PostForm("chat_retention_days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 0 || days > models.MaxChatRetentionDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The chat retention must be a number of days up to " + strconv.Itoa(models.MaxChatRetentionDays) + ", 0 keeps the chat forever"})
+			return
+		}
+		event.ChatRetentionDays = &days
+	}
+
+	// Handle the file uploads, "file" is kept for the single image clients and "files" holds the gallery
+	fileHeaders, err := eventFormFiles(c)
+	if err != nil {
 		span.RecordError(err) // Trace the error
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to retrieve file: " + err.Error()})
 		return
 	}
 
-	// If a file is uploaded, process it (e.g., upload it to S3)
-	if file != nil {
-		cfg := c.MustGet("config").(*config.Config)
-		fileURL, err := UploadFileToS3(ctx, cfg, file, fileHeader, event.ID, event.Name) // Pass context for tracing
+	// If files are uploaded, process them (e.g., upload them to S3)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+	if len(fileHeaders) > 0 {
+		images, err := uploadEventImages(ctx, cfg, store, &event, fileHeaders, c.PostFormArray("captions"), userID, models.ImageStatusApproved, 0)
 		if err != nil {
 			span.RecordError(err) // Trace the error
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file to S3: " + err.Error()})
+			if media.IsValidationError(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file: " + err.Error()})
 			return
 		}
-		event.FileURL = fileURL
+		// The first image is the cover of the event
+		images[0].IsCover = true
+		event.FileKey = images[0].Key
+		event.ThumbnailKey = images[0].ThumbnailKey
+		event.WebPKey = images[0].WebPKey
+		event.Images = images
 		// Add file-related attributes to the trace
 		span.SetAttributes(
-			attribute.String("file.name", fileHeader.Filename),
-			attribute.String("file.url", fileURL),
+			attribute.Int("file.count", len(images)),
+			attribute.String("file.key", event.FileKey),
 		)
 	}
 
@@ -238,6 +341,8 @@ func CreateEventHandler(c *gin.Context) {
 	_, dbSpan := tracer.Start(ctx, "DB_SaveEvent") // Start a span for the DB operation
 	if err := db.Create(&event).Error; err != nil {
 		dbSpan.RecordError(err) // Trace the error
+		// Do not leave the uploaded images behind
+		deleteEventImageFiles(ctx, cfg, store, event.Images)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create event"})
 		dbSpan.End() // End the DB span
 		return
@@ -251,6 +356,12 @@ func CreateEventHandler(c *gin.Context) {
 		attribute.String("event.location", event.Location),
 	)
 
+	if err := signEventMedia(ctx, cfg, store, &event); err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+
 	// Respond with the created event
 	c.JSON(http.StatusCreated, event)
 }
@@ -279,6 +390,17 @@ func JoinEventHandler(c *gin.Context) {
 		return
 	}
 
+	if event.CancelledAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "The event is cancelled"})
+		return
+	}
+
+	// Private events are joined with the invite code shared by the creator
+	if event.Private && event.CreatorID != userID && c.Query("invite_code") != event.InviteCode {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return
+	}
+
 	// Check if the user has already joined the event
 	var userEvent models.UserEvent
 	if err := db.Where("user_id = ? AND event_id = ?", userID, eventID).First(&userEvent).Error; err == nil {
@@ -301,6 +423,8 @@ func JoinEventHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join event"})
 		return
 	}
+	publishMembership(c, event.ID, websockets.TypeMemberJoined, userID)
+	publishAttendees(c, db, &event, userID, true)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Successfully joined the event"})
 }
@@ -353,6 +477,133 @@ func UnjoinEventHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave event"})
 		return
 	}
+	// The user cannot read the chat anymore, its open sockets are closed
+	publishMembership(c, event.ID, websockets.TypeMemberRemoved, userID)
+	publishAttendees(c, db, &event, userID, false)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Successfully left the event"})
 }
+
+// loadOwnEvent retrieves the event of the URL when the user created it, it writes the error response when it fails
+func loadOwnEvent(c *gin.Context, db *gorm.DB, userID uint) (*models.Event, bool) {
+	event, ok := loadVisibleEvent(c, db, userID)
+	if !ok {
+		return nil, false
+	}
+	if event.CreatorID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the creator can change the event"})
+		return nil, false
+	}
+	if event.CancelledAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "The event is cancelled"})
+		return nil, false
+	}
+	return event, true
+}
+
+// UpdateEventHandler changes the fields of the event sent in the body, the viewers receive the changed fields in event.updated
+func UpdateEventHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input struct {
+		Name              *string `json:"name"`
+		Location          *string `json:"location"`
+		Description       *string `json:"description"`
+		Date              *string `json:"date"`
+		ChatRetentionDays *int    `json:"chat_retention_days"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	event, ok := loadOwnEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	// The changes are keyed by their JSON name, they are the payload of event.updated
+	changes := map[string]interface{}{}
+	for field, value := range map[string]*string{"name": input.Name, "location": input.Location} {
+		if value == nil {
+			continue
+		}
+		if strings.TrimSpace(*value) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The " + field + " cannot be empty"})
+			return
+		}
+		changes[field] = *value
+	}
+	if input.Description != nil {
+		changes["description"] = *input.Description
+	}
+	if input.Date != nil {
+		date, err := parseEventDate(*input.Date)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Expected formats: YYYY-MM-DD or RFC3339"})
+			return
+		}
+		changes["date"] = date
+	}
+	if input.ChatRetentionDays != nil {
+		if *input.ChatRetentionDays < 0 || *input.ChatRetentionDays > models.MaxChatRetentionDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The chat retention must be a number of days up to " + strconv.Itoa(models.MaxChatRetentionDays) + ", 0 keeps the chat forever"})
+			return
+		}
+		changes["chat_retention_days"] = *input.ChatRetentionDays
+	}
+	if len(changes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+	changes["updated_at"] = time.Now()
+
+	// The JSON names of the fields are their column names
+	if err := db.Model(event).Updates(changes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update event"})
+		return
+	}
+	publishEventChange(c, event.ID, websockets.TypeEventUpdated, changes)
+
+	if err := signEventMedia(c.Request.Context(), cfg, store, event); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+	c.JSON(http.StatusOK, event)
+}
+
+// CancelEventHandler cancels the event, the viewers receive event.cancelled. The attendees and the chat are kept.
+func CancelEventHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadOwnEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	// The condition keeps the first cancellation when two requests race
+	result := db.Model(&models.Event{}).Where("id = ? AND cancelled_at IS NULL", event.ID).
+		Updates(map[string]interface{}{"cancelled_at": now, "updated_at": now})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel event"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "The event is cancelled"})
+		return
+	}
+	publishEventChange(c, event.ID, websockets.TypeEventCancelled, gin.H{"cancelled_at": now})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Event cancelled", "cancelled_at": now})
+}
@@ -0,0 +1,513 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/media"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// eventFormFiles returns the images sent with the "file" and "files" form fields
+func eventFormFiles(c *gin.Context) ([]*multipart.FileHeader, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		if errors.Is(err, http.ErrNotMultipart) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	fileHeaders := append([]*multipart.FileHeader{}, form.File["file"]...)
+	return append(fileHeaders, form.File["files"]...), nil
+}
+
+// uploadEventImages stores the files and returns the matching gallery images, positioned after startPosition.
+// Nothing is left in the bucket when one of the uploads fails.
+func uploadEventImages(ctx context.Context, cfg *config.Config, store storage.Storage, event *models.Event, fileHeaders []*multipart.FileHeader, captions []string, uploaderID uint, status string, startPosition int) ([]models.EventImage, error) {
+	images := make([]models.EventImage, 0, len(fileHeaders))
+	for i, fileHeader := range fileHeaders {
+		file, err := fileHeader.Open()
+		if err != nil {
+			deleteEventImageFiles(ctx, cfg, store, images)
+			return nil, err
+		}
+		uploaded, err := UploadEventImage(ctx, cfg, store, file, fileHeader, event.ID, event.Name)
+		file.Close()
+		if err != nil {
+			deleteEventImageFiles(ctx, cfg, store, images)
+			return nil, err
+		}
+
+		image := models.EventImage{
+			EventID:      event.ID,
+			UploaderID:   uploaderID,
+			Key:          uploaded.Key,
+			ThumbnailKey: uploaded.ThumbnailKey,
+			WebPKey:      uploaded.WebPKey,
+			Position:     startPosition + i,
+			Status:       status,
+		}
+		if i < len(captions) {
+			image.Caption = captions[i]
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// deleteEventImageFiles removes the images from the storage, failures are only logged
+func deleteEventImageFiles(ctx context.Context, cfg *config.Config, store storage.Storage, images []models.EventImage) {
+	for _, image := range images {
+		for _, key := range image.Keys() {
+			if err := DeleteEventFile(ctx, cfg, store, key); err != nil {
+				logger.LogMessage("error", fmt.Sprintf("Failed to delete image %s: %v", key, err), "", map[string]interface{}{
+					"event_id": image.EventID,
+					"error":    err.Error(),
+				})
+			}
+		}
+	}
+}
+
+// nextImagePosition returns the position of an image appended at the end of the gallery
+func nextImagePosition(db *gorm.DB, eventID uint) (int, error) {
+	var lastPosition *int
+	if err := db.Model(&models.EventImage{}).Where("event_id = ?", eventID).Select("MAX(position)").Scan(&lastPosition).Error; err != nil {
+		return 0, err
+	}
+	if lastPosition == nil {
+		return 0, nil
+	}
+	return *lastPosition + 1, nil
+}
+
+// refreshEventCover makes the first approved image the cover when the event has no cover anymore
+func refreshEventCover(tx *gorm.DB, eventID uint) error {
+	var cover models.EventImage
+	err := tx.Where("event_id = ? AND is_cover = ?", eventID, true).First(&cover).Error
+	if err == nil {
+		return updateEventCoverKeys(tx, eventID, cover)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	err = tx.Where("event_id = ? AND status = ?", eventID, models.ImageStatusApproved).Order("position ASC").First(&cover).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return updateEventCoverKeys(tx, eventID, models.EventImage{})
+	}
+	if err != nil {
+		return err
+	}
+	return setEventCover(tx, eventID, cover)
+}
+
+// setEventCover flags the image as the only cover of the event and mirrors its keys on the event
+func setEventCover(tx *gorm.DB, eventID uint, image models.EventImage) error {
+	if err := tx.Model(&models.EventImage{}).Where("event_id = ? AND id <> ?", eventID, image.ID).Update("is_cover", false).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.EventImage{}).Where("id = ?", image.ID).Update("is_cover", true).Error; err != nil {
+		return err
+	}
+	return updateEventCoverKeys(tx, eventID, image)
+}
+
+// updateEventCoverKeys mirrors the keys of the cover image and of its variants on the event
+func updateEventCoverKeys(tx *gorm.DB, eventID uint, cover models.EventImage) error {
+	return tx.Model(&models.Event{}).Where("id = ?", eventID).Updates(map[string]interface{}{
+		"file_key":      cover.Key,
+		"thumbnail_key": cover.ThumbnailKey,
+		"webp_key":      cover.WebPKey,
+	}).Error
+}
+
+// loadEventImage resolves the event and the image of the URL, it writes the error response when it fails
+func loadEventImage(c *gin.Context, db *gorm.DB) (*models.Event, *models.EventImage, bool) {
+	eventID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return nil, nil, false
+	}
+	imageID, err := strconv.ParseUint(c.Param("imageId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return nil, nil, false
+	}
+
+	var event models.Event
+	if err := db.First(&event, eventID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
+		}
+		return nil, nil, false
+	}
+
+	var image models.EventImage
+	if err := db.Where("id = ? AND event_id = ?", imageID, eventID).First(&image).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve image"})
+		}
+		return nil, nil, false
+	}
+	return &event, &image, true
+}
+
+func ListEventImagesHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadVisibleEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	// Pending images are only visible to the creator who moderates them
+	status := models.ImageStatusApproved
+	if event.CreatorID == userID && c.Query("status") == models.ImageStatusPending {
+		status = models.ImageStatusPending
+	}
+
+	var images []models.EventImage
+	if err := db.Where("event_id = ? AND status = ?", event.ID, status).Order("position ASC").Find(&images).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve images"})
+		return
+	}
+	if err := signEventImages(c.Request.Context(), cfg, store, images); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, images)
+}
+
+// UploadEventImagesHandler adds images to the gallery. The creator can upload at any time,
+// attendees can contribute photos once the event took place and they wait for the creator approval.
+func UploadEventImagesHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+	eventID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var event models.Event
+	if err := db.First(&event, eventID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
+		}
+		return
+	}
+
+	status, ok := galleryUploadStatus(c, db, &event, userID)
+	if !ok {
+		return
+	}
+
+	fileHeaders, err := eventFormFiles(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to retrieve file: " + err.Error()})
+		return
+	}
+	if len(fileHeaders) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		return
+	}
+
+	startPosition, err := nextImagePosition(db, event.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve images"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	images, err := uploadEventImages(ctx, cfg, store, &event, fileHeaders, c.PostFormArray("captions"), userID, status, startPosition)
+	if err != nil {
+		if media.IsValidationError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file: " + err.Error()})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&images).Error; err != nil {
+			return err
+		}
+		return refreshEventCover(tx, event.ID)
+	})
+	if err != nil {
+		deleteEventImageFiles(ctx, cfg, store, images)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save images"})
+		return
+	}
+	if err := signEventImages(ctx, cfg, store, images); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, images)
+}
+
+func UpdateEventImageHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	event, image, ok := loadEventImage(c, db)
+	if !ok {
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+	if event.CreatorID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the event creator can manage the gallery"})
+		return
+	}
+
+	var input struct {
+		Caption *string `json:"caption"`
+		IsCover *bool   `json:"is_cover"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.IsCover != nil && *input.IsCover && image.Status != models.ImageStatusApproved {
+		c.JSON(http.StatusConflict, gin.H{"error": "A pending image cannot be the cover"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if input.Caption != nil {
+			image.Caption = *input.Caption
+			if err := tx.Model(image).Update("caption", image.Caption).Error; err != nil {
+				return err
+			}
+		}
+		if input.IsCover != nil {
+			if *input.IsCover {
+				image.IsCover = true
+				return setEventCover(tx, event.ID, *image)
+			}
+			image.IsCover = false
+			if err := tx.Model(image).Update("is_cover", false).Error; err != nil {
+				return err
+			}
+			return refreshEventCover(tx, event.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update image"})
+		return
+	}
+
+	store := c.MustGet("storage").(storage.Storage)
+	images := []models.EventImage{*image}
+	if err := signEventImages(c.Request.Context(), c.MustGet("config").(*config.Config), store, images); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, images[0])
+}
+
+// ReorderEventImagesHandler sets the gallery order, images missing from the list keep their relative order after the listed ones
+func ReorderEventImagesHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	eventID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	var input struct {
+		ImageIDs []uint `json:"image_ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var event models.Event
+	if err := db.First(&event, eventID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
+		}
+		return
+	}
+	if event.CreatorID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the event creator can manage the gallery"})
+		return
+	}
+
+	var images []models.EventImage
+	if err := db.Where("event_id = ?", event.ID).Order("position ASC").Find(&images).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve images"})
+		return
+	}
+
+	positions := make(map[uint]int, len(input.ImageIDs))
+	for i, id := range input.ImageIDs {
+		positions[id] = i
+	}
+	next := len(input.ImageIDs)
+	for i := range images {
+		if position, ok := positions[images[i].ID]; ok {
+			images[i].Position = position
+			delete(positions, images[i].ID)
+		} else {
+			images[i].Position = next
+			next++
+		}
+	}
+	if len(positions) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown image in the list"})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, image := range images {
+			if err := tx.Model(&models.EventImage{}).Where("id = ?", image.ID).Update("position", image.Position).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reorder images"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Gallery reordered"})
+}
+
+// ModerateEventImageHandler lets the creator approve or reject a photo contributed by an attendee
+func ModerateEventImageHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+	event, image, ok := loadEventImage(c, db)
+	if !ok {
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+	if event.CreatorID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the event creator can moderate the gallery"})
+		return
+	}
+
+	var input struct {
+		Approved *bool `json:"approved" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if image.Status != models.ImageStatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Image is not waiting for moderation"})
+		return
+	}
+
+	if *input.Approved {
+		image.Status = models.ImageStatusApproved
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(image).Update("status", image.Status).Error; err != nil {
+				return err
+			}
+			return refreshEventCover(tx, event.ID)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve image"})
+			return
+		}
+		images := []models.EventImage{*image}
+		if err := signEventImages(c.Request.Context(), cfg, store, images); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+			return
+		}
+		c.JSON(http.StatusOK, images[0])
+		return
+	}
+
+	// Rejected photos are not kept
+	if err := db.Delete(image).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reject image"})
+		return
+	}
+	deleteEventImageFiles(c.Request.Context(), cfg, store, []models.EventImage{*image})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Image rejected"})
+}
+
+// DeleteEventImageHandler removes an image from the gallery and from the storage, the creator can delete any image
+// and attendees their own contributions
+func DeleteEventImageHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+	event, image, ok := loadEventImage(c, db)
+	if !ok {
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+	if event.CreatorID != userID && image.UploaderID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to delete this image"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(image).Error; err != nil {
+			return err
+		}
+		return refreshEventCover(tx, event.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image"})
+		return
+	}
+	deleteEventImageFiles(c.Request.Context(), cfg, store, []models.EventImage{*image})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Image deleted"})
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/contentfilter"
+	"github.com/devops-360-online/go-with-me/internal/ratelimit"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+)
+
+// Codes of the system messages sent to the author of a refused message, and when the chat expires
+const (
+	systemRateLimited     = "rate_limited"
+	systemMessageTooLong  = "message_too_long"
+	systemMessageRejected = "message_rejected"
+	systemChatExpired     = "chat_expired"
+)
+
+// chatGuard applies the limits of the chat to the messages of the users
+type chatGuard struct {
+	maxLength int
+	limiter   *ratelimit.TokenBucket
+	signals   *ratelimit.TokenBucket
+	filter    contentfilter.Filter
+}
+
+func newChatGuard(c *gin.Context) *chatGuard {
+	return &chatGuard{
+		maxLength: c.MustGet("config").(*config.Config).ChatMessageMaxLength,
+		limiter:   c.MustGet("chatLimiter").(*ratelimit.TokenBucket),
+		signals:   c.MustGet("chatSignalLimiter").(*ratelimit.TokenBucket),
+		filter:    c.MustGet("contentFilter").(contentfilter.Filter),
+	}
+}
+
+// throttle takes a token of the user in the room, it returns the system message to send when the user is throttled
+func (g *chatGuard) throttle(ctx context.Context, room string, userID uint) (*websockets.SystemPayload, error) {
+	return limit(ctx, g.limiter, room, userID)
+}
+
+// throttleSignal takes a token of the typing and read actions of the user in the room, like throttle
+func (g *chatGuard) throttleSignal(ctx context.Context, room string, userID uint) (*websockets.SystemPayload, error) {
+	return limit(ctx, g.signals, room, userID)
+}
+
+func limit(ctx context.Context, limiter *ratelimit.TokenBucket, room string, userID uint) (*websockets.SystemPayload, error) {
+	allowed, wait, err := limiter.Allow(ctx, room+":"+strconv.FormatUint(uint64(userID), 10))
+	if err != nil || allowed {
+		return nil, err
+	}
+	return &websockets.SystemPayload{
+		Code:       systemRateLimited,
+		Message:    fmt.Sprintf("You are sending messages too fast, wait %d seconds", int(math.Ceil(wait.Seconds()))),
+		RetryAfter: wait.Milliseconds(),
+	}, nil
+}
+
+// checkContent applies the length cap and the content filter, it returns the system message to send when the content is refused
+func (g *chatGuard) checkContent(content string) (*websockets.SystemPayload, error) {
+	if g.maxLength > 0 && utf8.RuneCountInString(content) > g.maxLength {
+		return &websockets.SystemPayload{
+			Code:    systemMessageTooLong,
+			Message: fmt.Sprintf("The message is longer than %d characters", g.maxLength),
+		}, nil
+	}
+	var rejection *contentfilter.Rejection
+	if err := g.filter.Check(content); errors.As(err, &rejection) {
+		return &websockets.SystemPayload{Code: systemMessageRejected, Message: rejection.Reason}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// refusedStatus is the HTTP status of a message refused by the guard
+func refusedStatus(refusal *websockets.SystemPayload) int {
+	switch refusal.Code {
+	case systemRateLimited:
+		return http.StatusTooManyRequests
+	case systemMessageTooLong:
+		return http.StatusRequestEntityTooLarge
+	case systemChatExpired:
+		return http.StatusGone
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// LivenessHandler reports the process is running
+func LivenessHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadinessHandler reports whether the dependencies needed to serve requests are reachable
+func ReadinessHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := gin.H{}
+	ready := true
+
+	sqlDB, err := db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		checks["database"] = err.Error()
+		ready = false
+	} else {
+		checks["database"] = "ok"
+	}
+
+	if err := storage.PingBuckets(ctx, store, storage.Buckets(cfg)); err != nil {
+		checks["storage"] = err.Error()
+		ready = false
+	} else {
+		checks["storage"] = "ok"
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": checks})
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// publishEventChange sends a change of the event to its viewers and to its chat, a failure is only logged
+func publishEventChange(c *gin.Context, eventID uint, envelopeType string, payload interface{}) {
+	hub := c.MustGet("hub").(*websockets.Hub)
+	envelope, err := websockets.NewEnvelope(envelopeType, eventID, payload)
+	if err == nil {
+		rooms := []string{websockets.EventViewersRoom(eventID), websockets.EventRoom(eventID)}
+		err = hub.PublishMany(c.Request.Context(), rooms, envelope)
+	}
+	if err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to publish %s: %v", envelopeType, err), "", map[string]interface{}{
+			"event_id": eventID,
+		})
+	}
+}
+
+// publishAttendees sends the new attendee count of the event after a user joined or left it.
+// A user leaving a private event cannot see it anymore, its viewers are closed like its chat sockets.
+func publishAttendees(c *gin.Context, db *gorm.DB, event *models.Event, userID uint, joined bool) {
+	var count int64
+	if err := db.Model(&models.UserEvent{}).Where("event_id = ?", event.ID).Count(&count).Error; err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to count the attendees: %v", err), "", map[string]interface{}{
+			"event_id": event.ID,
+		})
+		return
+	}
+	publishEventChange(c, event.ID, websockets.TypeAttendeesChanged, websockets.AttendeesPayload{
+		UserID:        userID,
+		Joined:        joined,
+		AttendeeCount: count,
+	})
+
+	if !joined && event.Private && event.CreatorID != userID {
+		hub := c.MustGet("hub").(*websockets.Hub)
+		envelope, err := websockets.NewEnvelope(websockets.TypeMemberRemoved, event.ID, websockets.MemberPayload{UserID: userID})
+		if err == nil {
+			err = hub.Publish(c.Request.Context(), websockets.EventViewersRoom(event.ID), envelope)
+		}
+		if err != nil {
+			logger.LogMessage("error", fmt.Sprintf("Failed to close the viewers: %v", err), "", map[string]interface{}{
+				"event_id": event.ID,
+			})
+		}
+	}
+}
+
+// EventViewerHandler opens a socket receiving the changes of an event: event.updated, event.cancelled and event.attendees.
+// Every user who can see the event can connect, the socket only receives. It resumes with last_id like the chat sockets.
+func EventViewerHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	hub := c.MustGet("hub").(*websockets.Hub)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	// Only the users who can see the event can connect, before the upgrade so the client gets the HTTP status
+	event, ok := loadVisibleEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	conn, err := newUpgrader(cfg).Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+
+	client := websockets.NewClient(conn, websockets.EventViewersRoom(event.ID), userID)
+	// The socket lives as long as the token which opened it
+	if exp, ok := claims["exp"].(float64); ok && exp > 0 {
+		client.ExpireAt(time.Unix(int64(exp), 0))
+	}
+	go client.WritePump()
+	// The client loads the event with GetEventHandler, there is no history to send
+	registerClient(c, hub, client, func(payload *websockets.SystemPayload) (*websockets.Envelope, error) {
+		return websockets.NewEnvelope(websockets.TypeSystem, event.ID, payload)
+	})
+	defer hub.Unregister(client)
+
+	// The socket only receives, reading handles the pongs and the close of the client
+	for {
+		var discarded json.RawMessage
+		if err := client.ReadJSON(&discarded); err != nil {
+			break
+		}
+	}
+}
+
+// EventViewerStreamHandler delivers the changes of an event as server-sent events, like EventViewerHandler
+func EventViewerStreamHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	hub := c.MustGet("hub").(*websockets.Hub)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadVisibleEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	client := websockets.NewStreamClient(websockets.EventViewersRoom(event.ID), userID)
+	serveEventStream(c, hub, client, func() func() {
+		registerClient(c, hub, client, func(payload *websockets.SystemPayload) (*websockets.Envelope, error) {
+			return websockets.NewEnvelope(websockets.TypeSystem, event.ID, payload)
+		})
+		return func() {}
+	})
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// presignEventFile returns a short-lived URL of a file of the events bucket, empty keys give empty URLs
+func presignEventFile(ctx context.Context, cfg *config.Config, store storage.Storage, key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	return store.PresignGet(ctx, cfg.S3BucketNameEvents, key, cfg.MediaURLTTL)
+}
+
+// signEventImages fills the URLs of the images and of their variants.
+// Callers must have checked the user can view the event.
+func signEventImages(ctx context.Context, cfg *config.Config, store storage.Storage, images []models.EventImage) error {
+	for i := range images {
+		image := &images[i]
+		// The direct uploads are not served before their metadata is stripped
+		if image.Status == models.ImageStatusProcessing {
+			continue
+		}
+		for _, file := range []struct {
+			key string
+			url *string
+		}{
+			{image.Key, &image.URL},
+			{image.ThumbnailKey, &image.ThumbnailURL},
+			{image.WebPKey, &image.WebPURL},
+		} {
+			signed, err := presignEventFile(ctx, cfg, store, file.key)
+			if err != nil {
+				return err
+			}
+			*file.url = signed
+		}
+	}
+	return nil
+}
+
+// signEventMedia fills the URLs of the cover and of the gallery of the event.
+// Callers must have checked the user can view the event.
+func signEventMedia(ctx context.Context, cfg *config.Config, store storage.Storage, event *models.Event) error {
+	for _, file := range []struct {
+		key string
+		url *string
+	}{
+		{event.FileKey, &event.FileURL},
+		{event.ThumbnailKey, &event.ThumbnailURL},
+		{event.WebPKey, &event.WebPURL},
+	} {
+		signed, err := presignEventFile(ctx, cfg, store, file.key)
+		if err != nil {
+			return err
+		}
+		*file.url = signed
+	}
+	return signEventImages(ctx, cfg, store, event.Images)
+}
+
+// loadVisibleEvent retrieves the event of the URL when the user can view it, it writes the error response when it fails.
+// Private events are reported as not found to the users who cannot see them.
+func loadVisibleEvent(c *gin.Context, db *gorm.DB, userID uint) (*models.Event, bool) {
+	eventID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return nil, false
+	}
+
+	var event models.Event
+	if err := db.First(&event, eventID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
+		}
+		return nil, false
+	}
+
+	visible, err := models.CanViewEvent(db, &event, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check event participation"})
+		return nil, false
+	}
+	if !visible {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		return nil, false
+	}
+	return &event, true
+}
+
+// LocalMediaHandler serves the files of the local storage from the URLs signed by the storage.
+// The signature replaces the authentication so the URLs can be used by the browsers in <img> tags.
+func LocalMediaHandler(c *gin.Context) {
+	store, ok := c.MustGet("storage").(*storage.LocalStorage)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	bucket := c.Param("bucket")
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	file, expiresAt, err := store.OpenSigned(bucket, key, c.Query("expires"), c.Query("signature"))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrInvalidSignature):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+		case errors.Is(err, storage.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		}
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	// The link can be cached by the browser until it expires, never by shared caches
+	maxAge := int(time.Until(expiresAt).Seconds())
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	// ServeContent handles the range requests and the conditional requests
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
+}
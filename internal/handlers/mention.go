@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/notifications"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"gorm.io/gorm"
+)
+
+const (
+	// mentionExcerptLength is the number of characters of the message copied in the notifications
+	mentionExcerptLength = 140
+	// mentionNotifyTimeout bounds the notifications of a message, the emails go through Kafka
+	mentionNotifyTimeout = 30 * time.Second
+)
+
+// resolveMentions returns the members of the chat mentioned with @name in the content
+func resolveMentions(db *gorm.DB, target chatTarget, content string) ([]models.User, error) {
+	if !strings.Contains(content, "@") {
+		return nil, nil
+	}
+	memberIDs, err := target.memberIDs(db)
+	if err != nil {
+		return nil, err
+	}
+	var members []models.User
+	if err := db.Select("id", "name", "email").Where("id IN ?", memberIDs).Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return parseMentions(content, members), nil
+}
+
+// parseMentions returns the users whose name follows an @ in the content, whatever the case.
+// The longest names are matched first so "@Ann Lee" does not mention Ann too.
+func parseMentions(content string, users []models.User) []models.User {
+	lower := strings.ToLower(content)
+	sorted := append([]models.User(nil), users...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Name) > len(sorted[j].Name) })
+
+	taken := make([]bool, len(lower))
+	var mentioned []models.User
+	for _, user := range sorted {
+		name := strings.ToLower(strings.TrimSpace(user.Name))
+		if name == "" {
+			continue
+		}
+		needle := "@" + name
+		for offset := 0; offset < len(lower); {
+			index := strings.Index(lower[offset:], needle)
+			if index < 0 {
+				break
+			}
+			start, end := offset+index, offset+index+len(needle)
+			offset = start + 1
+			if taken[start] || !mentionBoundary(lower, start, end) {
+				continue
+			}
+			for i := start; i < end; i++ {
+				taken[i] = true
+			}
+			mentioned = append(mentioned, user)
+			break
+		}
+	}
+	return mentioned
+}
+
+// mentionBoundary reports whether the mention is a word of its own, it is not part of an email or of a longer name
+func mentionBoundary(content string, start, end int) bool {
+	if start > 0 {
+		before, _ := utf8.DecodeLastRuneInString(content[:start])
+		if unicode.IsLetter(before) || unicode.IsDigit(before) {
+			return false
+		}
+	}
+	if end < len(content) {
+		after, _ := utf8.DecodeRuneInString(content[end:])
+		if unicode.IsLetter(after) || unicode.IsDigit(after) || after == '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func userIDs(users []models.User) []uint {
+	ids := make([]uint, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
+// mentionExcerpt returns the beginning of the content for the notifications
+func mentionExcerpt(content string) string {
+	if utf8.RuneCountInString(content) <= mentionExcerptLength {
+		return content
+	}
+	return string([]rune(content)[:mentionExcerptLength]) + "…"
+}
+
+// notifyMentionsAsync runs notifyMentions in the background, the sender does not wait for the notifications and the emails
+func notifyMentionsAsync(notifier *notifications.Notifier, presence *websockets.Presence, target chatTarget, msg models.Message, users []models.User) {
+	if notifier == nil || len(users) == 0 {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mentionNotifyTimeout)
+		defer cancel()
+		if err := notifyMentions(ctx, notifier, presence, target, &msg, users); err != nil {
+			logger.LogMessage("error", fmt.Sprintf("Failed to notify mentions: %v", err), "", map[string]interface{}{
+				"event_id":   msg.EventID,
+				"message_id": msg.ID.Hex(),
+			})
+		}
+	}()
+}
+
+// notifyMentions notifies the mentioned users who are not connected to the chat, the others see the message.
+// The sender is never notified.
+func notifyMentions(ctx context.Context, notifier *notifications.Notifier, presence *websockets.Presence, target chatTarget, msg *models.Message, users []models.User) error {
+	if notifier == nil || len(users) == 0 {
+		return nil
+	}
+
+	var errs []error
+	connected := make(map[uint]bool)
+	online, err := presence.Online(ctx, target.room())
+	if err != nil {
+		// Notifying a connected user is better than missing one
+		errs = append(errs, err)
+	}
+	for _, id := range online {
+		connected[id] = true
+	}
+
+	excerpt := mentionExcerpt(msg.Content)
+	for _, user := range users {
+		if user.ID == msg.SenderID || connected[user.ID] {
+			continue
+		}
+		notification := &models.Notification{
+			UserID:         user.ID,
+			Type:           models.NotificationMention,
+			EventID:        msg.EventID,
+			ConversationID: msg.ConversationID,
+			MessageID:      msg.ID,
+			SenderID:       msg.SenderID,
+			Excerpt:        excerpt,
+			CreatedAt:      time.Now(),
+		}
+		email := &notifications.Email{
+			To:      user.Email,
+			Subject: fmt.Sprintf("You were mentioned in %s", target.title()),
+			Body:    excerpt,
+		}
+		if err := notifier.Notify(ctx, notification, email); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
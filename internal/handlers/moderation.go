@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/notifications"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+// sanctionEnvelopeTypes are the envelopes announcing a new sanction
+var sanctionEnvelopeTypes = map[string]string{
+	models.SanctionMute: websockets.TypeUserMuted,
+	models.SanctionBan:  websockets.TypeUserBanned,
+}
+
+// sanctionsCollection returns the collection of the mutes and bans of the chats
+func sanctionsCollection(c *gin.Context) *mongo.Collection {
+	cfg := c.MustGet("config").(*config.Config)
+	mongoClient := c.MustGet("mongoClient").(*mongo.Client)
+	return mongoClient.Database(cfg.MongoDatabase).Collection("chat_sanctions")
+}
+
+// activeSanctionsFilter matches the sanctions of the event which did not expire,
+// the TTL index only removes the expired ones once a minute
+func activeSanctionsFilter(eventID uint) bson.M {
+	return bson.M{
+		"event_id": eventID,
+		"$or": bson.A{
+			bson.M{"expires_at": nil},
+			bson.M{"expires_at": bson.M{"$gt": time.Now()}},
+		},
+	}
+}
+
+// isSanctioned tells whether the user has an active sanction of the type in the chat of the event
+func isSanctioned(ctx context.Context, collection *mongo.Collection, eventID, userID uint, sanctionType string) (bool, error) {
+	filter := activeSanctionsFilter(eventID)
+	filter["user_id"] = userID
+	filter["type"] = sanctionType
+	count, err := collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// loadChatMessage retrieves the message of the URL in the chat of the event, it writes the error response when it fails
+func loadChatMessage(c *gin.Context, collection *mongo.Collection, eventID uint) (*models.Message, bool) {
+	messageID, err := primitive.ObjectIDFromHex(c.Param("messageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return nil, false
+	}
+	var msg models.Message
+	err = collection.FindOne(c.Request.Context(), bson.M{"_id": messageID, "event_id": eventID}).Decode(&msg)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve message"})
+		}
+		return nil, false
+	}
+	return &msg, true
+}
+
+// publishChatEnvelope sends an envelope to the sockets of the chat of the event, a failure is only logged
+func publishChatEnvelope(c *gin.Context, eventID uint, envelopeType string, payload interface{}) {
+	hub := c.MustGet("hub").(*websockets.Hub)
+	envelope, err := websockets.NewEnvelope(envelopeType, eventID, payload)
+	if err == nil {
+		err = hub.Publish(c.Request.Context(), websockets.EventRoom(eventID), envelope)
+	}
+	if err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to publish %s: %v", envelopeType, err), "", map[string]interface{}{
+			"event_id": eventID,
+		})
+	}
+}
+
+// EditMessageHandler changes the content of a message of the sender within the edit window,
+// the previous content is kept in the edit history
+func EditMessageHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+	collection := messagesCollection(c)
+	msg, ok := loadChatMessage(c, collection, event.ID)
+	if !ok {
+		return
+	}
+
+	if msg.SenderID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only edit your own messages"})
+		return
+	}
+	if msg.Deleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Message was deleted"})
+		return
+	}
+	if time.Since(msg.Timestamp) > cfg.ChatEditWindow {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The edit window of this message is over"})
+		return
+	}
+	muted, err := isSanctioned(c.Request.Context(), sanctionsCollection(c), event.ID, userID, models.SanctionMute)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check chat sanctions"})
+		return
+	}
+	if muted {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are muted in this chat"})
+		return
+	}
+	if input.Content == msg.Content {
+		c.JSON(http.StatusOK, msg)
+		return
+	}
+
+	// The edits are limited and filtered like the new messages
+	guard := newChatGuard(c)
+	refusal, err := guard.throttle(c.Request.Context(), websockets.EventRoom(event.ID), userID)
+	if err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to apply the chat rate limit: %v", err), "", nil)
+	}
+	if refusal == nil {
+		if refusal, err = guard.checkContent(input.Content); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check message content"})
+			return
+		}
+	}
+	if refusal != nil {
+		if refusal.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.FormatInt((refusal.RetryAfter+999)/1000, 10))
+		}
+		c.JSON(refusedStatus(refusal), gin.H{"error": refusal.Message, "code": refusal.Code})
+		return
+	}
+
+	mentioned, err := resolveMentions(db, eventTarget(event), input.Content)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve mentions"})
+		return
+	}
+	previousMentions := make(map[uint]bool, len(msg.Mentions))
+	for _, id := range msg.Mentions {
+		previousMentions[id] = true
+	}
+
+	// The update only applies to the content which was read, a concurrent edit or delete makes it fail
+	now := time.Now()
+	result, err := collection.UpdateOne(c.Request.Context(),
+		bson.M{"_id": msg.ID, "content": msg.Content, "deleted": bson.M{"$ne": true}},
+		bson.M{
+			"$set":  bson.M{"content": input.Content, "edited_at": now, "mentions": userIDs(mentioned)},
+			"$push": bson.M{"edits": models.MessageEdit{Content: msg.Content, EditedAt: now}},
+		})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to edit message"})
+		return
+	}
+	if result.ModifiedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Message was changed meanwhile, reload it and retry"})
+		return
+	}
+	msg.Content = input.Content
+	msg.EditedAt = &now
+	msg.Mentions = userIDs(mentioned)
+
+	// Only the users added by the edit are notified
+	var added []models.User
+	for _, user := range mentioned {
+		if !previousMentions[user.ID] {
+			added = append(added, user)
+		}
+	}
+	notifier := c.MustGet("notifier").(*notifications.Notifier)
+	presence := c.MustGet("presence").(*websockets.Presence)
+	notifyMentionsAsync(notifier, presence, eventTarget(event), *msg, added)
+
+	// The message is broadcast, without the reactions of the editor
+	messages := []models.Message{*msg}
+	if err := prepareMessages(c.Request.Context(), cfg, store, messages, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+	msg = &messages[0]
+	publishChatEnvelope(c, event.ID, websockets.TypeMessageEdited, msg)
+	c.JSON(http.StatusOK, msg)
+}
+
+// DeleteMessageHandler deletes a message of the sender within the edit window, the creator of the event deletes
+// any message. The message stays in the history without its content, its attachments are collected by the reconciler.
+func DeleteMessageHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+	collection := messagesCollection(c)
+	msg, ok := loadChatMessage(c, collection, event.ID)
+	if !ok {
+		return
+	}
+
+	if event.CreatorID != userID {
+		if msg.SenderID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to delete this message"})
+			return
+		}
+		if time.Since(msg.Timestamp) > cfg.ChatEditWindow {
+			c.JSON(http.StatusForbidden, gin.H{"error": "The edit window of this message is over"})
+			return
+		}
+	}
+	if msg.Deleted {
+		c.JSON(http.StatusOK, gin.H{"message": "Message deleted"})
+		return
+	}
+
+	now := time.Now()
+	_, err := collection.UpdateOne(c.Request.Context(), bson.M{"_id": msg.ID}, bson.M{
+		"$set":   bson.M{"deleted": true, "deleted_by": userID, "deleted_at": now, "content": ""},
+		"$unset": bson.M{"attachments": "", "edits": "", "reactions": ""},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	// Without their documents the files of the attachments are orphans removed by the reconciler
+	if len(msg.Attachments) > 0 {
+		if _, err := attachmentsCollection(c).DeleteMany(c.Request.Context(), bson.M{"message_id": msg.ID}); err != nil {
+			logger.LogMessage("error", fmt.Sprintf("Failed to delete message attachments: %v", err), "", map[string]interface{}{
+				"event_id":   event.ID,
+				"message_id": msg.ID.Hex(),
+			})
+		}
+	}
+
+	publishChatEnvelope(c, event.ID, websockets.TypeMessageDeleted, gin.H{"id": msg.ID, "deleted_by": userID, "deleted_at": now})
+	c.JSON(http.StatusOK, gin.H{"message": "Message deleted"})
+}
+
+// ListMessageEditsHandler returns the previous versions of a message, oldest first
+func ListMessageEditsHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+	msg, ok := loadChatMessage(c, messagesCollection(c), event.ID)
+	if !ok {
+		return
+	}
+	edits := msg.Edits
+	if edits == nil {
+		edits = []models.MessageEdit{}
+	}
+	c.JSON(http.StatusOK, gin.H{"edits": edits})
+}
+
+// loadModeratedEvent retrieves the event of the URL when the user created it, it writes the error response when it fails
+func loadModeratedEvent(c *gin.Context, db *gorm.DB, userID uint) (*models.Event, bool) {
+	event, ok := loadVisibleEvent(c, db, userID)
+	if !ok {
+		return nil, false
+	}
+	if event.CreatorID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the creator of the event can moderate its chat"})
+		return nil, false
+	}
+	return event, true
+}
+
+// SanctionUserHandler mutes or bans a user from the chat of the event, the sockets of a banned user are closed.
+// A new sanction of the same type replaces the previous one.
+func SanctionUserHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input struct {
+		UserID uint   `json:"user_id" binding:"required"`
+		Type   string `json:"type" binding:"required,oneof=mute ban"`
+		Reason string `json:"reason" binding:"max=500"`
+		// Duration in minutes, a sanction without duration is permanent
+		Duration int `json:"duration" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	event, ok := loadModeratedEvent(c, db, userID)
+	if !ok {
+		return
+	}
+	if input.UserID == event.CreatorID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The creator of the event cannot be sanctioned"})
+		return
+	}
+
+	sanction := models.ChatSanction{
+		EventID:   event.ID,
+		UserID:    input.UserID,
+		Type:      input.Type,
+		Reason:    input.Reason,
+		CreatedBy: userID,
+		CreatedAt: time.Now(),
+	}
+	if input.Duration > 0 {
+		expiresAt := sanction.CreatedAt.Add(time.Duration(input.Duration) * time.Minute)
+		sanction.ExpiresAt = &expiresAt
+	}
+
+	filter := bson.M{"event_id": event.ID, "user_id": input.UserID, "type": input.Type}
+	err := sanctionsCollection(c).FindOneAndReplace(c.Request.Context(), filter, sanction,
+		options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.After)).Decode(&sanction)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sanction user"})
+		return
+	}
+
+	publishChatEnvelope(c, event.ID, sanctionEnvelopeTypes[sanction.Type], sanction)
+	c.JSON(http.StatusCreated, sanction)
+}
+
+// LiftSanctionHandler removes the sanction of the type given in the query from a user of the chat
+func LiftSanctionHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	sanctionedID, err := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	sanctionType := c.Query("type")
+	if _, ok := sanctionEnvelopeTypes[sanctionType]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The type must be mute or ban"})
+		return
+	}
+
+	event, ok := loadModeratedEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	result, err := sanctionsCollection(c).DeleteOne(c.Request.Context(), bson.M{
+		"event_id": event.ID,
+		"user_id":  uint(sanctionedID),
+		"type":     sanctionType,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lift sanction"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sanction not found"})
+		return
+	}
+
+	publishChatEnvelope(c, event.ID, websockets.TypeSanctionLifted, gin.H{"user_id": uint(sanctionedID), "type": sanctionType})
+	c.JSON(http.StatusOK, gin.H{"message": "Sanction lifted"})
+}
+
+// ListSanctionsHandler returns the active sanctions of the chat of the event
+func ListSanctionsHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadModeratedEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	cursor, err := sanctionsCollection(c).Find(c.Request.Context(), activeSanctionsFilter(event.ID),
+		options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sanctions"})
+		return
+	}
+	sanctions := []models.ChatSanction{}
+	if err := cursor.All(c.Request.Context(), &sanctions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sanctions"})
+		return
+	}
+	c.JSON(http.StatusOK, sanctions)
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// notificationsCollection returns the collection of the in-app notifications
+func notificationsCollection(c *gin.Context) *mongo.Collection {
+	cfg := c.MustGet("config").(*config.Config)
+	mongoClient := c.MustGet("mongoClient").(*mongo.Client)
+	return mongoClient.Database(cfg.MongoDatabase).Collection("notifications")
+}
+
+// ListNotificationsHandler returns the notifications of the user, newest first.
+// The next page is requested with the ID of the last notification in before, unread=true skips the read ones.
+func ListNotificationsHandler(c *gin.Context) {
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	filter := bson.M{"user_id": userID}
+	if value := c.Query("before"); value != "" {
+		before, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+			return
+		}
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	if c.Query("unread") == "true" {
+		filter["read"] = false
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(chatHistorySize)))
+	if limit < 1 || limit > 100 {
+		limit = chatHistorySize
+	}
+
+	// One more notification tells whether there is a next page
+	cursor, err := notificationsCollection(c).Find(c.Request.Context(), filter,
+		options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(limit)+1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve notifications"})
+		return
+	}
+	notifications := []models.Notification{}
+	if err := cursor.All(c.Request.Context(), &notifications); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve notifications"})
+		return
+	}
+	hasMore := len(notifications) > limit
+	if hasMore {
+		notifications = notifications[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications, "has_more": hasMore})
+}
+
+// ReadNotificationsHandler marks notifications of the user as read, all of them without ids
+func ReadNotificationsHandler(c *gin.Context) {
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input struct {
+		IDs []string `json:"ids"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := bson.M{"user_id": userID, "read": false}
+	if len(input.IDs) > 0 {
+		ids := make([]primitive.ObjectID, 0, len(input.IDs))
+		for _, value := range input.IDs {
+			id, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+				return
+			}
+			ids = append(ids, id)
+		}
+		filter["_id"] = bson.M{"$in": ids}
+	}
+
+	result, err := notificationsCollection(c).UpdateMany(c.Request.Context(), filter, bson.M{"$set": bson.M{"read": true}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"updated": result.ModifiedCount})
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Actions a client sends instead of a message, they are broadcast and never saved
+const (
+	chatActionTypingStart = "typing.start"
+	chatActionTypingStop  = "typing.stop"
+)
+
+var typingEnvelopeTypes = map[string]string{
+	chatActionTypingStart: websockets.TypeTypingStarted,
+	chatActionTypingStop:  websockets.TypeTypingStopped,
+}
+
+// trackPresence marks the client online in the room of the event until it is closed, the room is notified
+// when the first socket of the user joins and when the last one leaves. It returns the function to call on close.
+func trackPresence(hub *websockets.Hub, presence *websockets.Presence, client *websockets.Client, eventID uint) func() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first, err := presence.Join(ctx, client.Room(), client.UserID(), client.ID())
+	if err != nil {
+		logPresenceError("join", err, eventID, client.UserID())
+	} else if first {
+		publishPresence(ctx, hub, client.Room(), websockets.TypePresenceJoined, eventID, client.UserID())
+	}
+
+	// The new socket gets the users already online, the others are announced by presence.joined
+	if userIDs, err := presence.Online(ctx, client.Room()); err != nil {
+		logPresenceError("list", err, eventID, client.UserID())
+	} else if envelope, err := websockets.NewEnvelope(websockets.TypePresenceState, eventID, websockets.PresenceStatePayload{UserIDs: userIDs}); err == nil {
+		client.SendJSON(envelope)
+	}
+
+	go func() {
+		ticker := time.NewTicker(websockets.PresenceRefreshPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-client.Done():
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := presence.Refresh(ctx, client.Room(), client.UserID(), client.ID()); err != nil {
+					logPresenceError("refresh", err, eventID, client.UserID())
+				}
+				cancel()
+			}
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		last, err := presence.Leave(ctx, client.Room(), client.UserID(), client.ID())
+		if err != nil {
+			logPresenceError("leave", err, eventID, client.UserID())
+			return
+		}
+		if last {
+			publishPresence(ctx, hub, client.Room(), websockets.TypePresenceLeft, eventID, client.UserID())
+		}
+	}
+}
+
+// publishPresence sends a presence or typing envelope about the user to the sockets of the room
+func publishPresence(ctx context.Context, hub *websockets.Hub, room, envelopeType string, eventID, userID uint) {
+	envelope, err := websockets.NewEnvelope(envelopeType, eventID, websockets.PresencePayload{UserID: userID})
+	if err == nil {
+		err = hub.Publish(ctx, room, envelope)
+	}
+	if err != nil {
+		logPresenceError("publish "+envelopeType, err, eventID, userID)
+	}
+}
+
+func logPresenceError(action string, err error, eventID, userID uint) {
+	logger.LogMessage("error", fmt.Sprintf("Failed to %s presence: %v", action, err), "", map[string]interface{}{
+		"event_id": eventID,
+		"user_id":  userID,
+	})
+}
+
+// EventPresenceHandler returns the users connected to the chat of the event
+func EventPresenceHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	presence := c.MustGet("presence").(*websockets.Presence)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	userIDs, err := presence.Online(c.Request.Context(), websockets.EventRoom(event.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve presence"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user_ids": userIDs})
+}
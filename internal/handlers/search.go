@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+const (
+	searchPageSize = 20
+	// maxSearchOffset bounds the pages skipped by the text search, which cannot use a cursor
+	maxSearchOffset = 1000
+	maxSearchLength = 200
+)
+
+// searchResult is a message matching the search, Highlight is its HTML escaped content with the matches in <mark>
+type searchResult struct {
+	Message   models.Message `json:"message"`
+	Score     float64        `json:"score"`
+	Highlight string         `json:"highlight"`
+}
+
+// SearchMessagesHandler searches the messages of the event chat with the MongoDB text index, the best matches first.
+// The results are filtered by sender_id and by date with from and to (RFC 3339), and paginated with offset and limit.
+func SearchMessagesHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The q parameter is required"})
+		return
+	}
+	if len(query) > maxSearchLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The search is too long"})
+		return
+	}
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{"event_id": event.ID, "$text": bson.M{"$search": query}, "deleted": bson.M{"$ne": true}}
+	if value := c.Query("sender_id"); value != "" {
+		senderID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sender ID"})
+			return
+		}
+		filter["sender_id"] = uint(senderID)
+	}
+	timestamp := bson.M{}
+	for param, operator := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " date, use RFC 3339"})
+			return
+		}
+		timestamp[operator] = date
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(searchPageSize)))
+	if limit < 1 || limit > 100 {
+		limit = searchPageSize
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if offset < 0 || offset > maxSearchOffset {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The offset must be between 0 and " + strconv.Itoa(maxSearchOffset)})
+		return
+	}
+
+	// One more message tells whether there is a next page
+	score := bson.M{"$meta": "textScore"}
+	cursor, err := messagesCollection(c).Find(c.Request.Context(), filter, options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit)+1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search messages"})
+		return
+	}
+	var matches []struct {
+		models.Message `bson:",inline"`
+		Score          float64 `bson:"score"`
+	}
+	if err := cursor.All(c.Request.Context(), &matches); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search messages"})
+		return
+	}
+	hasMore := len(matches) > limit
+	if hasMore {
+		matches = matches[:limit]
+	}
+
+	messages := make([]models.Message, len(matches))
+	for i := range matches {
+		messages[i] = matches[i].Message
+	}
+	if err := prepareMessages(c.Request.Context(), cfg, store, messages, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+	terms := searchTerms(query)
+	results := make([]searchResult, len(messages))
+	for i := range messages {
+		results[i] = searchResult{
+			Message:   messages[i],
+			Score:     matches[i].Score,
+			Highlight: highlightMatches(messages[i].Content, terms),
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results, "has_more": hasMore})
+}
+
+// searchTerms splits the search like MongoDB: the quoted phrases and the words, without the negated ones
+func searchTerms(query string) []string {
+	var terms []string
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			if phrase := strings.TrimSpace(part); phrase != "" {
+				terms = append(terms, phrase)
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			if strings.HasPrefix(word, "-") {
+				continue
+			}
+			word = strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+			if word != "" {
+				terms = append(terms, word)
+			}
+		}
+	}
+	return terms
+}
+
+// highlightMatches escapes the content and wraps the terms in <mark>, the words match whole words whatever the case
+func highlightMatches(content string, terms []string) string {
+	var ranges [][2]int
+	words := make(map[string]bool)
+	for _, term := range terms {
+		// The phrases and the words with punctuation are matched as is
+		if strings.ContainsFunc(term, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			for _, match := range regexp.MustCompile("(?i)"+regexp.QuoteMeta(term)).FindAllStringIndex(content, -1) {
+				ranges = append(ranges, [2]int{match[0], match[1]})
+			}
+			continue
+		}
+		words[strings.ToLower(term)] = true
+	}
+	for start := 0; start < len(content); {
+		r, size := utf8.DecodeRuneInString(content[start:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			start += size
+			continue
+		}
+		end := start
+		for end < len(content) {
+			r, size := utf8.DecodeRuneInString(content[end:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				break
+			}
+			end += size
+		}
+		if words[strings.ToLower(content[start:end])] {
+			ranges = append(ranges, [2]int{start, end})
+		}
+		start = end
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var builder strings.Builder
+	position := 0
+	for _, r := range ranges {
+		if r[1] <= position {
+			continue
+		}
+		if r[0] < position {
+			// The part of an overlapping match which is already marked is skipped
+			r[0] = position
+		}
+		builder.WriteString(html.EscapeString(content[position:r[0]]))
+		builder.WriteString("<mark>")
+		builder.WriteString(html.EscapeString(content[r[0]:r[1]]))
+		builder.WriteString("</mark>")
+		position = r[1]
+	}
+	builder.WriteString(html.EscapeString(content[position:]))
+	return builder.String()
+}
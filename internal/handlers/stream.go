@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// EventStreamHandler delivers the envelopes of the chat of an event as server-sent events, for the networks
+// which block the websockets. It sends the same envelopes as EventChatHandler and resumes from the Last-Event-ID header,
+// the messages are sent with SendMessageHandler.
+func EventStreamHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+	hub := c.MustGet("hub").(*websockets.Hub)
+	presence := c.MustGet("presence").(*websockets.Presence)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	client := websockets.NewStreamClient(websockets.EventRoom(event.ID), userID)
+	serveEventStream(c, hub, client, func() func() {
+		// A reconnecting client gets the envelopes it missed, the others the previous messages
+		history := registerClient(c, hub, client, func(payload *websockets.SystemPayload) (*websockets.Envelope, error) {
+			return websockets.NewEnvelope(websockets.TypeSystem, event.ID, payload)
+		})
+		leave := trackPresence(hub, presence, client, event.ID)
+		if history {
+			go sendPreviousMessages(client, event.ID, messagesCollection(c), cfg, store)
+		}
+		return leave
+	})
+}
+
+// serveEventStream writes the envelopes of the client as server-sent events until the request ends or the hub closes it.
+// connect registers the client once the stream is open, it returns the function to call when the stream ends.
+func serveEventStream(c *gin.Context, hub *websockets.Hub, client *websockets.Client, connect func() func()) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// The proxies would buffer the events otherwise
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// The stream lives as long as the token which opened it
+	if exp, ok := jwt.ExtractClaims(c)["exp"].(float64); ok && exp > 0 {
+		client.ExpireAt(time.Unix(int64(exp), 0))
+	}
+	pumped := make(chan struct{})
+	go func() {
+		defer close(pumped)
+		client.StreamPump(c.Writer, c.Writer.Flush)
+	}()
+
+	disconnect := connect()
+	select {
+	case <-c.Request.Context().Done():
+	case <-client.Done():
+	}
+	disconnect()
+	hub.Unregister(client)
+	<-pumped
+}
+
+// SendMessageHandler sends a message or a reaction to the chat of an event over HTTP, the body is the one of the websocket messages.
+// The message is returned with 201, or with 200 when it was already sent with the same client_id.
+func SendMessageHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input chatMessageInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch input.Type {
+	case "":
+		if input.Content == "" && len(input.AttachmentIDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The message is empty"})
+			return
+		}
+	case chatActionReactionAdd, chatActionReactionRemove:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown message type"})
+		return
+	}
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	outcome, err := newChatService(c).send(c.Request.Context(), eventTarget(event), userID, input)
+	writeChatOutcome(c, outcome, err)
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+// Actions changing the reactions to a message
+const (
+	chatActionReactionAdd    = "reaction.add"
+	chatActionReactionRemove = "reaction.remove"
+)
+
+const (
+	// maxMessageReactions is the number of distinct emojis on a message
+	maxMessageReactions = 20
+	// maxReactionBytes is enough for the emojis made of several code points
+	maxReactionBytes = 32
+)
+
+var (
+	errInvalidReaction  = errors.New("invalid reaction, it must be an emoji")
+	errReactionRejected = errors.New("message not found, deleted or with too many reactions")
+	errInvalidReplyTo   = errors.New("the message to reply to was not found or deleted")
+)
+
+// reactionPayload is the payload of the reaction envelopes, Count is the number of users left with the emoji
+type reactionPayload struct {
+	MessageID primitive.ObjectID `json:"message_id"`
+	Emoji     string             `json:"emoji"`
+	UserID    uint               `json:"user_id"`
+	Count     int                `json:"count"`
+}
+
+// validReaction accepts the emojis, they are keys of the reactions document so "." and "$" are refused
+func validReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > maxReactionBytes || !utf8.ValidString(emoji) || strings.ContainsAny(emoji, ".$") {
+		return false
+	}
+	ascii := true
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+		if r > unicode.MaxASCII {
+			ascii = false
+		}
+	}
+	return !ascii
+}
+
+// applyReaction adds or removes the reaction of the user to a message of the event and notifies the room
+func applyReaction(ctx context.Context, collection *mongo.Collection, hub *websockets.Hub, room string, eventID, userID uint, input chatMessageInput) error {
+	messageID, err := primitive.ObjectIDFromHex(input.MessageID)
+	if err != nil {
+		return errReactionRejected
+	}
+	if !validReaction(input.Emoji) {
+		return errInvalidReaction
+	}
+
+	field := "reactions." + input.Emoji
+	filter := bson.M{"_id": messageID, "event_id": eventID, "deleted": bson.M{"$ne": true}}
+	update := bson.M{"$pull": bson.M{field: userID}}
+	envelopeType := websockets.TypeReactionRemoved
+	if input.Type == chatActionReactionAdd {
+		// A new emoji is only accepted below the limit of distinct reactions
+		filter["$or"] = bson.A{
+			bson.M{field: bson.M{"$exists": true}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{
+				bson.M{"$size": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$reactions", bson.M{}}}}},
+				maxMessageReactions,
+			}}},
+		}
+		update = bson.M{"$addToSet": bson.M{field: userID}}
+		envelopeType = websockets.TypeReactionAdded
+	}
+
+	var msg models.Message
+	err = collection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{field: 1})).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errReactionRejected
+	}
+	if err != nil {
+		return err
+	}
+	count := len(msg.Reactions[input.Emoji])
+	if count == 0 {
+		// The emoji does not count in the limit once nobody uses it
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": messageID, field: bson.M{"$size": 0}}, bson.M{"$unset": bson.M{field: ""}}); err != nil {
+			return err
+		}
+	}
+
+	envelope, err := websockets.NewEnvelope(envelopeType, eventID, reactionPayload{
+		MessageID: messageID,
+		Emoji:     input.Emoji,
+		UserID:    userID,
+		Count:     count,
+	})
+	if err != nil {
+		return err
+	}
+	return hub.Publish(ctx, room, envelope)
+}
+
+// findThreadRoot returns the root of the thread of the message to reply to, a reply to a reply joins the same thread
+func findThreadRoot(ctx context.Context, collection *mongo.Collection, eventID uint, replyTo string) (*primitive.ObjectID, error) {
+	messageID, err := primitive.ObjectIDFromHex(replyTo)
+	if err != nil {
+		return nil, errInvalidReplyTo
+	}
+	var msg models.Message
+	err = collection.FindOne(ctx, bson.M{"_id": messageID, "event_id": eventID, "deleted": bson.M{"$ne": true}},
+		options.FindOne().SetProjection(bson.M{"reply_to": 1})).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errInvalidReplyTo
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg.ReplyTo != nil {
+		return msg.ReplyTo, nil
+	}
+	return &msg.ID, nil
+}
+
+// countReply updates the summary of the thread of the root message with a new reply
+func countReply(ctx context.Context, collection *mongo.Collection, rootID primitive.ObjectID, at time.Time) error {
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": rootID}, bson.M{
+		"$inc": bson.M{"reply_count": 1},
+		"$max": bson.M{"last_reply_at": at},
+	})
+	return err
+}
+
+// ThreadHandler returns a root message with the replies of its thread, paginated like the history
+func ThreadHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	store := c.MustGet("storage").(storage.Storage)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+	collection := messagesCollection(c)
+	root, ok := loadChatMessage(c, collection, event.ID)
+	if !ok {
+		return
+	}
+	if root.ReplyTo != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message is a reply, its thread is the one of reply_to"})
+		return
+	}
+
+	replies, hasMore, ok := findMessagesPage(c, collection, bson.M{"event_id": event.ID, "reply_to": root.ID}, userID)
+	if !ok {
+		return
+	}
+	roots := []models.Message{*root}
+	if err := prepareMessages(c.Request.Context(), cfg, store, roots, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign media URLs"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"root": roots[0], "replies": replies, "has_more": hasMore})
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+// chatActionRead moves the read marker of the user to MessageID
+const chatActionRead = "read"
+
+var errInvalidRead = errors.New("the message to mark as read was not found")
+
+// readPayload is the payload of the read receipts
+type readPayload struct {
+	UserID    uint               `json:"user_id"`
+	MessageID primitive.ObjectID `json:"message_id"`
+}
+
+// unreadMessagePayload tells the sockets of a user that a message arrived in the chat of an event
+type unreadMessagePayload struct {
+	EventID   uint               `json:"event_id"`
+	MessageID primitive.ObjectID `json:"message_id"`
+	SenderID  uint               `json:"sender_id"`
+}
+
+// readsCollection returns the collection of the read markers of the chats
+func readsCollection(c *gin.Context) *mongo.Collection {
+	cfg := c.MustGet("config").(*config.Config)
+	mongoClient := c.MustGet("mongoClient").(*mongo.Client)
+	return mongoClient.Database(cfg.MongoDatabase).Collection("chat_reads")
+}
+
+// chatEventIDs returns the events whose chat the user takes part in, the ones the user created or joined
+func chatEventIDs(db *gorm.DB, userID uint) ([]uint, error) {
+	var ids []uint
+	err := db.Model(&models.Event{}).
+		Where("creator_id = ? OR id IN (?)", userID,
+			db.Session(&gorm.Session{NewDB: true}).Model(&models.UserEvent{}).Select("event_id").Where("user_id = ?", userID)).
+		Order("id").Pluck("id", &ids).Error
+	return ids, err
+}
+
+// chatMemberIDs returns the users taking part in the chat of the event
+func chatMemberIDs(db *gorm.DB, event *models.Event) ([]uint, error) {
+	var ids []uint
+	if err := db.Model(&models.UserEvent{}).Where("event_id = ?", event.ID).Pluck("user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if id == event.CreatorID {
+			return ids, nil
+		}
+	}
+	return append(ids, event.CreatorID), nil
+}
+
+// unreadCounts counts the messages of the history of each event sent by the others after the read marker of the user
+func unreadCounts(ctx context.Context, messages, reads *mongo.Collection, userID uint, eventIDs []uint) ([]models.UnreadCount, error) {
+	counts := make([]models.UnreadCount, 0, len(eventIDs))
+	if len(eventIDs) == 0 {
+		return counts, nil
+	}
+
+	cursor, err := reads.Find(ctx, bson.M{"user_id": userID, "event_id": bson.M{"$in": eventIDs}})
+	if err != nil {
+		return nil, err
+	}
+	var markers []models.ChatRead
+	if err := cursor.All(ctx, &markers); err != nil {
+		return nil, err
+	}
+	lastRead := make(map[uint]primitive.ObjectID, len(markers))
+	for _, marker := range markers {
+		lastRead[marker.EventID] = marker.LastReadID
+	}
+
+	// A single aggregation counts every event, each one from its own marker
+	events := make(bson.A, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		filter := bson.M{"event_id": eventID}
+		if id, ok := lastRead[eventID]; ok {
+			filter["_id"] = bson.M{"$gt": id}
+		}
+		events = append(events, filter)
+	}
+	cursor, err = messages.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"$or":       events,
+			"sender_id": bson.M{"$ne": userID},
+			"deleted":   bson.M{"$ne": true},
+			"reply_to":  bson.M{"$exists": false},
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": "$event_id", "unread": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		EventID uint  `bson:"_id"`
+		Unread  int64 `bson:"unread"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	unread := make(map[uint]int64, len(groups))
+	for _, group := range groups {
+		unread[group.EventID] = group.Unread
+	}
+
+	for _, eventID := range eventIDs {
+		count := models.UnreadCount{EventID: eventID, Unread: unread[eventID]}
+		if id, ok := lastRead[eventID]; ok {
+			count.LastReadID = &id
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+// readMessage moves the read marker of the user forward to the message and returns the unread count of the event.
+// The room gets the read receipt and the other sockets of the user the new count.
+func readMessage(ctx context.Context, hub *websockets.Hub, messages, reads *mongo.Collection, eventID, userID uint, messageID string) (*models.UnreadCount, error) {
+	id, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, errInvalidRead
+	}
+	count, err := messages.CountDocuments(ctx, bson.M{"_id": id, "event_id": eventID}, options.Count().SetLimit(1))
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errInvalidRead
+	}
+
+	// The marker never moves backwards, the upsert of an older message conflicts with the existing marker
+	result, err := reads.UpdateOne(ctx,
+		bson.M{"user_id": userID, "event_id": eventID, "last_read_id": bson.M{"$lt": id}},
+		bson.M{"$set": bson.M{"last_read_id": id, "updated_at": time.Now()}},
+		options.Update().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+	advanced := err == nil && (result.ModifiedCount > 0 || result.UpsertedCount > 0)
+
+	counts, err := unreadCounts(ctx, messages, reads, userID, []uint{eventID})
+	if err != nil {
+		return nil, err
+	}
+	unread := &counts[0]
+	if !advanced {
+		return unread, nil
+	}
+
+	if envelope, err := websockets.NewEnvelope(websockets.TypeMessageRead, eventID, readPayload{UserID: userID, MessageID: id}); err == nil {
+		if err := hub.Publish(ctx, websockets.EventRoom(eventID), envelope); err != nil {
+			log.Println("Redis publish error:", err)
+		}
+	}
+	if envelope, err := websockets.NewEnvelope(websockets.TypeUnreadUpdated, eventID, unread); err == nil {
+		if err := hub.Publish(ctx, websockets.UserRoom(userID), envelope); err != nil {
+			log.Println("Redis publish error:", err)
+		}
+	}
+	return unread, nil
+}
+
+// notifyUnread tells the sockets of the other members that a message arrived in the history of the event
+func notifyUnread(ctx context.Context, db *gorm.DB, hub *websockets.Hub, event *models.Event, msg *models.Message) error {
+	memberIDs, err := chatMemberIDs(db, event)
+	if err != nil {
+		return err
+	}
+	rooms := make([]string, 0, len(memberIDs))
+	for _, id := range memberIDs {
+		if id != msg.SenderID {
+			rooms = append(rooms, websockets.UserRoom(id))
+		}
+	}
+	envelope, err := websockets.NewEnvelope(websockets.TypeUnreadMessage, event.ID, unreadMessagePayload{
+		EventID:   event.ID,
+		MessageID: msg.ID,
+		SenderID:  msg.SenderID,
+	})
+	if err != nil {
+		return err
+	}
+	return hub.PublishMany(ctx, rooms, envelope)
+}
+
+// MarkReadHandler moves the read marker of the user in the chat of the event to a message
+func MarkReadHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	hub := c.MustGet("hub").(*websockets.Hub)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var input struct {
+		MessageID string `json:"message_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	event, ok := loadChatEvent(c, db, userID)
+	if !ok {
+		return
+	}
+
+	// The read markers share the bucket of the read actions of the socket
+	refusal, err := newChatGuard(c).throttleSignal(c.Request.Context(), websockets.EventRoom(event.ID), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark messages as read"})
+		return
+	}
+	if refusal != nil {
+		c.JSON(refusedStatus(refusal), gin.H{"error": refusal.Message, "code": refusal.Code})
+		return
+	}
+
+	unread, err := readMessage(c.Request.Context(), hub, messagesCollection(c), readsCollection(c), event.ID, userID, input.MessageID)
+	if err != nil {
+		if errors.Is(err, errInvalidRead) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark messages as read"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, unread)
+}
+
+// UnreadHandler returns the unread counts of the chats of the events the user created or joined
+func UnreadHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	eventIDs, err := chatEventIDs(db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve events"})
+		return
+	}
+	counts, err := unreadCounts(c.Request.Context(), messagesCollection(c), readsCollection(c), userID, eventIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread messages"})
+		return
+	}
+	var total int64
+	for _, count := range counts {
+		total += count.Unread
+	}
+	c.JSON(http.StatusOK, gin.H{"events": counts, "total": total})
+}
+
+// UserSocketHandler opens the socket of the user which receives the unread counts live.
+// It gets the counts of every chat when it connects, then unread.message and unread.updated.
+func UserSocketHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	hub := c.MustGet("hub").(*websockets.Hub)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	conn, err := newUpgrader(cfg).Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+
+	client := websockets.NewClient(conn, websockets.UserRoom(userID), userID)
+	// The socket lives as long as the token which opened it
+	if exp, ok := claims["exp"].(float64); ok && exp > 0 {
+		client.ExpireAt(time.Unix(int64(exp), 0))
+	}
+	hub.Register(client)
+	defer hub.Unregister(client)
+	go client.WritePump()
+
+	// The socket is registered first so no message is missed between the counts and the notifications
+	messages, reads := messagesCollection(c), readsCollection(c)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		eventIDs, err := chatEventIDs(db, userID)
+		if err != nil {
+			log.Println("Events error:", err)
+			return
+		}
+		counts, err := unreadCounts(ctx, messages, reads, userID, eventIDs)
+		if err != nil {
+			log.Println("Unread counts error:", err)
+			return
+		}
+		if envelope, err := websockets.NewEnvelope(websockets.TypeUnreadState, 0, counts); err == nil {
+			client.SendJSON(envelope)
+		}
+	}()
+
+	// The socket only receives, reading handles the pongs and the close of the client
+	for {
+		var discarded json.RawMessage
+		if err := client.ReadJSON(&discarded); err != nil {
+			break
+		}
+	}
+}
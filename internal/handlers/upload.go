@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// allowedUploadTypes maps the content types accepted for direct uploads to their extension
+var allowedUploadTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+}
+
+// eventUploadPrefix is the folder where a user uploads directly the images of an event
+func eventUploadPrefix(eventID, userID uint) string {
+	return fmt.Sprintf("events/uploads/%d/%d/", eventID, userID)
+}
+
+// galleryUploadStatus checks that the user can add images to the event and returns the status of the new images.
+// It writes the error response when the user is not allowed.
+func galleryUploadStatus(c *gin.Context, db *gorm.DB, event *models.Event, userID uint) (string, bool) {
+	if event.CreatorID == userID {
+		return models.ImageStatusApproved, true
+	}
+
+	member, err := models.IsEventMember(db, userID, event.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check event participation"})
+		return "", false
+	}
+	if !member {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only participants can add photos to this event"})
+		return "", false
+	}
+	if time.Now().Before(event.Date) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Photos can be shared once the event took place"})
+		return "", false
+	}
+	return models.ImageStatusPending, true
+}
+
+// CreateUploadURLHandler returns a presigned PUT URL so the client uploads an image of the event directly to the bucket.
+// The upload must then be confirmed with CompleteUploadHandler.
+func CreateUploadURLHandler(c *gin.Context) {
+	tracer := otel.Tracer("event-service")
+	ctx, span := tracer.Start(c.Request.Context(), "CreateUploadURLHandler")
+	defer span.End()
+
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	eventID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	var input struct {
+		ContentType string `json:"content_type" binding:"required"`
+		Size        int64  `json:"size" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ext, ok := allowedUploadTypes[input.ContentType]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file type not allowed: only PNG, JPEG files are accepted"})
+		return
+	}
+	if input.Size > cfg.MaxUploadBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("file is too large: maximum size is %d bytes", cfg.MaxUploadBytes)})
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var event models.Event
+	if err := db.First(&event, eventID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
+		}
+		return
+	}
+	if _, ok := galleryUploadStatus(c, db, &event, userID); !ok {
+		return
+	}
+
+	randomStr, err := generateRandomString(8)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare upload"})
+		return
+	}
+	key := fmt.Sprintf("%s%d-%s%s", eventUploadPrefix(event.ID, userID), time.Now().Unix(), randomStr, ext)
+	span.SetAttributes(attribute.String("file.key", key))
+
+	store := c.MustGet("storage").(storage.Storage)
+	presigned, err := store.PresignPut(ctx, cfg.S3BucketNameEvents, key, input.ContentType, input.Size, cfg.PresignedUploadTTL)
+	if errors.Is(err, storage.ErrNotSupported) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Direct uploads are not available, upload the file to the API"})
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare upload"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":        key,
+		"method":     presigned.Method,
+		"url":        presigned.URL,
+		"headers":    presigned.Headers,
+		"expires_at": time.Now().Add(cfg.PresignedUploadTTL),
+	})
+}
+
+// CompleteUploadHandler attaches an image uploaded with a presigned URL to the gallery of the event,
+// once the object was checked in the bucket. The image stays hidden with the processing status until
+// the UploadProcessor ran the image pipeline on it, it is returned with 202.
+func CompleteUploadHandler(c *gin.Context) {
+	tracer := otel.Tracer("event-service")
+	ctx, span := tracer.Start(c.Request.Context(), "CompleteUploadHandler")
+	defer span.End()
+
+	db := c.MustGet("db").(*gorm.DB)
+	cfg := c.MustGet("config").(*config.Config)
+	eventID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	var input struct {
+		Key     string `json:"key" binding:"required"`
+		Caption string `json:"caption"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	var event models.Event
+	if err := db.First(&event, eventID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Event not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
+		}
+		return
+	}
+	if _, ok := galleryUploadStatus(c, db, &event, userID); !ok {
+		return
+	}
+
+	// Users can only attach what they uploaded for this event
+	if !strings.HasPrefix(input.Key, eventUploadPrefix(event.ID, userID)) || strings.Contains(input.Key, "..") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Upload does not belong to this event"})
+		return
+	}
+	var count int64
+	if err := db.Model(&models.EventImage{}).Where("key = ?", input.Key).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve images"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload already attached"})
+		return
+	}
+	span.SetAttributes(attribute.String("file.key", input.Key))
+
+	// Check the object exists and respects the constraints of the presigned URL
+	store := c.MustGet("storage").(storage.Storage)
+	info, err := store.Stat(ctx, cfg.S3BucketNameEvents, input.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify upload"})
+		return
+	}
+	if info.Size > cfg.MaxUploadBytes {
+		DeleteEventFile(ctx, cfg, store, input.Key)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is too large"})
+		return
+	}
+
+	// Only the first bytes are read to sniff the real content type, the body never goes through the API
+	header, err := store.ReadRange(ctx, cfg.S3BucketNameEvents, input.Key, 0, 512)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify upload"})
+		return
+	}
+	// The content, the declared type and the extension of the key must all match
+	ext, ok := allowedUploadTypes[http.DetectContentType(header)]
+	if !ok || ext != filepath.Ext(input.Key) || allowedUploadTypes[info.ContentType] != ext {
+		DeleteEventFile(ctx, cfg, store, input.Key)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file type not allowed: only PNG, JPEG files are accepted"})
+		return
+	}
+
+	// New images are appended at the end of the gallery
+	position, err := nextImagePosition(db, event.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve images"})
+		return
+	}
+
+	image := models.EventImage{
+		EventID:    event.ID,
+		UploaderID: userID,
+		Key:        input.Key,
+		Caption:    input.Caption,
+		Position:   position,
+		Status:     models.ImageStatusProcessing,
+	}
+	if err := db.Create(&image).Error; err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+		return
+	}
+	// The upload still carries its metadata, it gets no URL until it is processed
+	c.MustGet("uploadProcessor").(*UploadProcessor).Enqueue(image.ID)
+
+	c.JSON(http.StatusAccepted, image)
+}
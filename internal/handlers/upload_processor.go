@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/media"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"gorm.io/gorm"
+)
+
+const (
+	// uploadQueueSize is the number of completed uploads waiting for the processor, the others wait for the next scan
+	uploadQueueSize = 100
+	// uploadScanDelay leaves the completed uploads to the replica which queued them before another one picks them
+	uploadScanDelay = time.Minute
+)
+
+// UploadProcessor runs the image pipeline on the images uploaded directly to the bucket: it reads the upload,
+// strips its metadata, stores the variants and swaps the keys of the image, which becomes visible.
+// The images are queued by CompleteUploadHandler, the ones left by a stopped replica are found by a periodic scan.
+type UploadProcessor struct {
+	db    *gorm.DB
+	cfg   *config.Config
+	store storage.Storage
+	queue chan uint
+}
+
+func NewUploadProcessor(db *gorm.DB, cfg *config.Config, store storage.Storage) *UploadProcessor {
+	return &UploadProcessor{db: db, cfg: cfg, store: store, queue: make(chan uint, uploadQueueSize)}
+}
+
+// Enqueue schedules the processing of the image, it never blocks
+func (p *UploadProcessor) Enqueue(imageID uint) {
+	select {
+	case p.queue <- imageID:
+	default:
+		// The scan picks it up
+	}
+}
+
+// Start processes the queued images, and every interval the ones still waiting, until the context is cancelled
+func (p *UploadProcessor) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case imageID := <-p.queue:
+			p.process(ctx, imageID)
+		case <-ticker.C:
+			var imageIDs []uint
+			err := p.db.Model(&models.EventImage{}).
+				Where("status = ? AND updated_at < ?", models.ImageStatusProcessing, time.Now().Add(-uploadScanDelay)).
+				Pluck("id", &imageIDs).Error
+			if err != nil {
+				logger.LogMessage("error", fmt.Sprintf("Failed to load the uploads to process: %v", err), "", nil)
+				continue
+			}
+			for _, imageID := range imageIDs {
+				p.process(ctx, imageID)
+			}
+		}
+	}
+}
+
+// process runs the pipeline on the image and logs the failures, the image stays hidden and is retried by the next scan
+func (p *UploadProcessor) process(ctx context.Context, imageID uint) {
+	if err := p.processImage(ctx, imageID); err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to process the upload: %v", err), "", map[string]interface{}{
+			"image_id": imageID,
+		})
+	}
+}
+
+func (p *UploadProcessor) processImage(ctx context.Context, imageID uint) error {
+	var image models.EventImage
+	err := p.db.Where("id = ? AND status = ?", imageID, models.ImageStatusProcessing).First(&image).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Already processed by another replica or deleted
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var event models.Event
+	if err := p.db.Select("id", "name", "creator_id").First(&event, image.EventID).Error; err != nil {
+		return err
+	}
+
+	// The upload was checked against MaxUploadBytes when it was completed, one more byte lets the pipeline reject a larger one
+	data, err := p.store.ReadRange(ctx, p.cfg.S3BucketNameEvents, image.Key, 0, p.cfg.MaxUploadBytes+1)
+	if errors.Is(err, storage.ErrNotFound) {
+		return p.reject(ctx, &image, err)
+	}
+	if err != nil {
+		return err
+	}
+	uploaded, err := storeEventImage(ctx, p.cfg, p.store, bytes.NewReader(data), event.ID, event.Name)
+	if media.IsValidationError(err) {
+		return p.reject(ctx, &image, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The images of the attendees still wait for the creator once processed
+	status := models.ImageStatusPending
+	if image.UploaderID == event.CreatorID {
+		status = models.ImageStatusApproved
+	}
+	var swapped bool
+	err = p.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.EventImage{}).Where("id = ? AND status = ?", image.ID, models.ImageStatusProcessing).Updates(map[string]interface{}{
+			"key":           uploaded.Key,
+			"thumbnail_key": uploaded.ThumbnailKey,
+			"webp_key":      uploaded.WebPKey,
+			"status":        status,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if swapped = result.RowsAffected > 0; !swapped {
+			return nil
+		}
+		return refreshEventCover(tx, event.ID)
+	})
+	if err != nil || !swapped {
+		// The image was deleted or processed by another replica meanwhile
+		deleteEventImageFiles(ctx, p.cfg, p.store, []models.EventImage{{
+			EventID: event.ID, Key: uploaded.Key, ThumbnailKey: uploaded.ThumbnailKey, WebPKey: uploaded.WebPKey,
+		}})
+		return err
+	}
+
+	// The upload still carries the metadata of the client
+	if err := DeleteEventFile(ctx, p.cfg, p.store, image.Key); err != nil {
+		logger.LogMessage("error", fmt.Sprintf("Failed to delete the processed upload: %v", err), "", map[string]interface{}{
+			"image_id": image.ID,
+			"key":      image.Key,
+		})
+	}
+	return nil
+}
+
+// reject removes an upload refused by the pipeline and its image
+func (p *UploadProcessor) reject(ctx context.Context, image *models.EventImage, reason error) error {
+	logger.LogMessage("info", fmt.Sprintf("Upload rejected: %v", reason), "", map[string]interface{}{
+		"image_id": image.ID,
+		"event_id": image.EventID,
+	})
+	if err := p.db.Where("status = ?", models.ImageStatusProcessing).Delete(&models.EventImage{}, image.ID).Error; err != nil {
+		return err
+	}
+	DeleteEventFile(ctx, p.cfg, p.store, image.Key)
+	return nil
+}
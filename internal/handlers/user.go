@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// UserProfile is the public view of a user, it never exposes the email or the password
+type UserProfile struct {
+	ID            uint                 `json:"id"`
+	Name          string               `json:"name"`
+	CreatedAt     time.Time            `json:"created_at"`
+	EventsCreated int64                `json:"events_created"`
+	CreatorRating models.RatingSummary `json:"creator_rating"`
+}
+
+func GetUserProfileHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		}
+		return
+	}
+
+	profile := UserProfile{
+		ID:        user.ID,
+		Name:      user.Name,
+		CreatedAt: user.CreatedAt,
+	}
+	if err := db.Model(&models.Event{}).Where("creator_id = ?", user.ID).Count(&profile.EventsCreated).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user events"})
+		return
+	}
+	profile.CreatorRating, err = models.GetCreatorRating(db, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve rating"})
+		return
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
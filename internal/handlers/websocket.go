@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/devops-360-online/go-with-me/config"
+	"github.com/devops-360-online/go-with-me/internal/middlewares"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+// newUpgrader accepts the websockets opened by the origins of the configuration.
+// Without allowlist only the origin of the API itself is accepted, "*" accepts every origin.
+func newUpgrader(cfg *config.Config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				// Not a browser
+				return true
+			}
+			if len(cfg.WebsocketAllowedOrigins) == 0 {
+				parsed, err := url.Parse(origin)
+				return err == nil && strings.EqualFold(parsed.Host, r.Host)
+			}
+			for _, allowed := range cfg.WebsocketAllowedOrigins {
+				if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// CreateWebsocketTicketHandler returns a single-use ticket opening a websocket with ?ticket=,
+// for the browsers which cannot send the Authorization header on a websocket
+func CreateWebsocketTicketHandler(c *gin.Context) {
+	rdb := c.MustGet("redisClient").(*redis.Client)
+
+	ticket, expiresAt, err := middlewares.IssueWebsocketTicket(c.Request.Context(), rdb, jwt.ExtractClaims(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create ticket"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ticket": ticket, "expires_at": expiresAt})
+}
+
+// CreateStreamTicketHandler returns a single-use ticket opening the stream of the event given by route,
+// "stream" for the chat or "live" for the changes of the event. EventSource clients fetch a new one to reconnect.
+func CreateStreamTicketHandler(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	rdb := c.MustGet("redisClient").(*redis.Client)
+
+	var input struct {
+		Route string `json:"route" binding:"required,oneof=stream live"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	// The chat stream is reserved to the members, the live stream to everyone who can see the event
+	var event *models.Event
+	var ok bool
+	if input.Route == middlewares.StreamRouteChat {
+		event, ok = loadChatEvent(c, db, userID)
+	} else {
+		event, ok = loadVisibleEvent(c, db, userID)
+	}
+	if !ok {
+		return
+	}
+
+	ticket, expiresAt, err := middlewares.IssueStreamTicket(c.Request.Context(), rdb, claims, strconv.FormatUint(uint64(event.ID), 10), input.Route)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create ticket"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ticket": ticket, "expires_at": expiresAt})
+}
+
+// CreateConversationStreamTicketHandler returns a single-use ticket opening the stream of the conversation
+func CreateConversationStreamTicketHandler(c *gin.Context) {
+	rdb := c.MustGet("redisClient").(*redis.Client)
+
+	// Get user ID from JWT
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims[middlewares.IdentityKey].(float64))
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+
+	ticket, expiresAt, err := middlewares.IssueStreamTicket(c.Request.Context(), rdb, claims, conversation.ID.Hex(), middlewares.StreamRouteConversation)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create ticket"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ticket": ticket, "expires_at": expiresAt})
+}
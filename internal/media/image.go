@@ -0,0 +1,142 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+)
+
+var (
+	ErrUnsupportedType = errors.New("file type not allowed: only PNG, JPEG files are accepted")
+	ErrFileTooLarge    = errors.New("file is too large")
+	ErrImageTooLarge   = errors.New("image dimensions are too large")
+)
+
+// Limits bounds what an uploaded image can be and how its variants are generated
+type Limits struct {
+	MaxBytes      int64 // Maximum size of the uploaded file
+	MaxDimension  int   // Maximum width or height of the uploaded image
+	ThumbnailSize int   // Bounding box of the thumbnail
+	WebPSize      int   // Bounding box of the WebP variant
+}
+
+// Variant is an encoded version of an image ready to be stored
+type Variant struct {
+	Data        []byte
+	ContentType string
+	Ext         string
+}
+
+// ProcessedImage is the result of ProcessImage, none of the variants carries the metadata of the upload
+type ProcessedImage struct {
+	Original  Variant
+	Thumbnail Variant
+	WebP      Variant
+	Width     int
+	Height    int
+}
+
+// IsValidationError reports whether the upload was rejected because of its content
+func IsValidationError(err error) bool {
+	return errors.Is(err, ErrUnsupportedType) || errors.Is(err, ErrFileTooLarge) || errors.Is(err, ErrImageTooLarge)
+}
+
+// ProcessImage checks the real type and the size of an uploaded image, strips its EXIF/GPS metadata
+// by re-encoding it and generates the thumbnail and WebP variants
+func ProcessImage(r io.Reader, limits Limits) (*ProcessedImage, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limits.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, ErrFileTooLarge
+	}
+
+	// Never trust the extension, look at the content
+	contentType := http.DetectContentType(data)
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return nil, ErrUnsupportedType
+	}
+
+	// Check the dimensions before decoding so a small file cannot allocate a huge image
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	if imgConfig.Width > limits.MaxDimension || imgConfig.Height > limits.MaxDimension {
+		return nil, ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+
+	// The orientation lives in the EXIF metadata we drop, apply it to the pixels first
+	if contentType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	processed := &ProcessedImage{
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}
+	if processed.Original, err = encode(img, contentType); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	if processed.Thumbnail, err = encode(fit(img, limits.ThumbnailSize), contentType); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	var webp bytes.Buffer
+	if err := nativewebp.Encode(&webp, fit(img, limits.WebPSize), nil); err != nil {
+		return nil, fmt.Errorf("failed to encode webp: %w", err)
+	}
+	processed.WebP = Variant{Data: webp.Bytes(), ContentType: "image/webp", Ext: ".webp"}
+
+	return processed, nil
+}
+
+// encode writes the image in the given format, the encoders of the standard library do not write any metadata
+func encode(img image.Image, contentType string) (Variant, error) {
+	var buf bytes.Buffer
+	if contentType == "image/png" {
+		if err := png.Encode(&buf, img); err != nil {
+			return Variant{}, err
+		}
+		return Variant{Data: buf.Bytes(), ContentType: contentType, Ext: ".png"}, nil
+	}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return Variant{}, err
+	}
+	return Variant{Data: buf.Bytes(), ContentType: "image/jpeg", Ext: ".jpg"}, nil
+}
+
+// fit scales the image down so it fits in a size x size box, smaller images are returned as is
+func fit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if size <= 0 || (width <= size && height <= size) {
+		return img
+	}
+
+	if width >= height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
@@ -0,0 +1,127 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// WebsocketTicketTTL is how long a ticket can be used to open a websocket or a stream
+const WebsocketTicketTTL = 30 * time.Second
+
+const (
+	websocketTicketPrefix = "ws:ticket:"
+	// The tickets of the streams never open a websocket, nor another stream than the one they were issued for
+	streamTicketPrefix = "stream:ticket:"
+)
+
+// The streams a stream ticket is issued for
+const (
+	StreamRouteChat         = "stream"
+	StreamRouteLive         = "live"
+	StreamRouteConversation = "conversation"
+)
+
+// websocketTicket is stored in Redis until the websocket or the stream is opened
+type websocketTicket struct {
+	UserID uint `json:"user_id"`
+	// Expiry of the token which issued the ticket, the websocket is closed when it is reached
+	Expiry int64 `json:"exp"`
+	// Target and Route bind the ticket of a stream to the stream it was issued for, Target is the ID of its URL
+	Target string `json:"target,omitempty"`
+	Route  string `json:"route,omitempty"`
+}
+
+// IssueWebsocketTicket stores a single-use ticket for the user of the claims, it is valid for WebsocketTicketTTL
+func IssueWebsocketTicket(ctx context.Context, rdb *redis.Client, claims jwt.MapClaims) (string, time.Time, error) {
+	return issueTicket(ctx, rdb, websocketTicketPrefix, claims, "", "")
+}
+
+// IssueStreamTicket stores a single-use ticket opening the stream of the route for the target, the event or the conversation
+// of its URL. It is valid for WebsocketTicketTTL.
+func IssueStreamTicket(ctx context.Context, rdb *redis.Client, claims jwt.MapClaims, target string, route string) (string, time.Time, error) {
+	return issueTicket(ctx, rdb, streamTicketPrefix, claims, target, route)
+}
+
+func issueTicket(ctx context.Context, rdb *redis.Client, prefix string, claims jwt.MapClaims, target string, route string) (string, time.Time, error) {
+	userID, ok := claims[IdentityKey].(float64)
+	if !ok {
+		return "", time.Time{}, errors.New("invalid token")
+	}
+	expiry, _ := claims["exp"].(float64)
+	data, err := json.Marshal(websocketTicket{UserID: uint(userID), Expiry: int64(expiry), Target: target, Route: route})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", time.Time{}, err
+	}
+	ticket := hex.EncodeToString(random)
+	if err := rdb.Set(ctx, prefix+ticket, data, WebsocketTicketTTL).Err(); err != nil {
+		return "", time.Time{}, err
+	}
+	return ticket, time.Now().Add(WebsocketTicketTTL), nil
+}
+
+// WebsocketAuth authenticates the websocket upgrades with the ticket query parameter, browsers cannot send
+// the Authorization header on a websocket. The other requests go through the JWT middleware.
+func WebsocketAuth(auth *jwt.GinJWTMiddleware, rdb *redis.Client) gin.HandlerFunc {
+	return ticketAuth(auth, rdb, websocketTicketPrefix, func(c *gin.Context, ticket *websocketTicket) bool {
+		return ticket.Route == ""
+	})
+}
+
+// StreamAuth authenticates the server-sent event streams of the route with a stream ticket, issued for the event
+// or the conversation of the URL and the route. Like the websocket tickets it is consumed: EventSource reconnects by itself with the same
+// URL, which fails, so the clients fetch a new ticket and reconnect with the last envelope ID.
+func StreamAuth(auth *jwt.GinJWTMiddleware, rdb *redis.Client, route string) gin.HandlerFunc {
+	return ticketAuth(auth, rdb, streamTicketPrefix, func(c *gin.Context, ticket *websocketTicket) bool {
+		return ticket.Route == route && ticket.Target == c.Param("id")
+	})
+}
+
+// ticketAuth consumes the ticket of the query with the prefix, and accepts it when valid returns true
+func ticketAuth(auth *jwt.GinJWTMiddleware, rdb *redis.Client, prefix string, valid func(c *gin.Context, ticket *websocketTicket) bool) gin.HandlerFunc {
+	jwtMiddleware := auth.MiddlewareFunc()
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if ticket == "" {
+			jwtMiddleware(c)
+			return
+		}
+
+		// GETDEL consumes the ticket, it cannot be replayed
+		data, err := rdb.GetDel(c.Request.Context(), prefix+ticket).Bytes()
+		if errors.Is(err, redis.Nil) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired ticket"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check ticket"})
+			return
+		}
+		var payload websocketTicket
+		if err := json.Unmarshal(data, &payload); err != nil || !valid(c, &payload) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired ticket"})
+			return
+		}
+		if payload.Expiry != 0 && time.Now().Unix() >= payload.Expiry {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token is expired"})
+			return
+		}
+
+		// The handlers read the user with jwt.ExtractClaims like on the other routes
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{IdentityKey: float64(payload.UserID), "exp": float64(payload.Expiry)})
+		c.Next()
+	}
+}
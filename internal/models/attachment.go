@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UnattachedAttachmentTTL is how long an uploaded attachment waits to be sent in a message before it is removed
+const UnattachedAttachmentTTL = 24 * time.Hour
+
+// MessageAttachment is the metadata of a chat attachment, it is copied in the messages sending it
+type MessageAttachment struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name        string             `bson:"name" json:"name"`
+	ContentType string             `bson:"content_type" json:"content_type"`
+	Size        int64              `bson:"size" json:"size"`
+	// Width and Height are only set for the images
+	Width  int `bson:"width,omitempty" json:"width,omitempty"`
+	Height int `bson:"height,omitempty" json:"height,omitempty"`
+	// Storage keys in the chat bucket, the thumbnail only exists for the images
+	Key          string `bson:"key" json:"-"`
+	ThumbnailKey string `bson:"thumbnail_key,omitempty" json:"-"`
+	// Signed URLs, they are generated for each response
+	URL          string `bson:"-" json:"url"`
+	ThumbnailURL string `bson:"-" json:"thumbnail_url,omitempty"`
+}
+
+// Keys returns the storage keys of the attachment and of its thumbnail
+func (a *MessageAttachment) Keys() []string {
+	keys := []string{a.Key}
+	if a.ThumbnailKey != "" {
+		keys = append(keys, a.ThumbnailKey)
+	}
+	return keys
+}
+
+// Attachment is a file uploaded in the chat of an event, it is stored in the "attachments" collection
+type Attachment struct {
+	MessageAttachment `bson:",inline"`
+	EventID           uint                `bson:"event_id" json:"event_id"`
+	UploaderID        uint                `bson:"uploader_id" json:"uploader_id"`
+	MessageID         *primitive.ObjectID `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	// Attached is set once the attachment was sent, the others expire after UnattachedAttachmentTTL
+	Attached  bool      `bson:"attached" json:"attached"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// ThumbnailSize counts the thumbnail in the quota of the chat
+	ThumbnailSize int64 `bson:"thumbnail_size,omitempty" json:"-"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChatRead is the last message a user read in the chat of an event, it is stored in the "chat_reads" collection
+type ChatRead struct {
+	EventID    uint               `bson:"event_id" json:"event_id"`
+	UserID     uint               `bson:"user_id" json:"user_id"`
+	LastReadID primitive.ObjectID `bson:"last_read_id" json:"last_read_id"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// UnreadCount is the number of messages of the chat of an event a user did not read
+type UnreadCount struct {
+	EventID    uint                `json:"event_id"`
+	Unread     int64               `json:"unread"`
+	LastReadID *primitive.ObjectID `json:"last_read_id,omitempty"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+type Comment struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	EventID   uint      `gorm:"not null;index" json:"event_id"`
+	UserID    uint      `gorm:"not null" json:"user_id"`
+	ParentID  *uint     `gorm:"index" json:"parent_id,omitempty"`
+	Content   string    `gorm:"type:text;not null" json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Replies is filled in when building the comment thread, it is not persisted
+	Replies []*Comment `gorm:"-" json:"replies,omitempty"`
+}
+
+// BuildCommentThreads nests replies under their parent and returns the root comments.
+// Comments are expected to be ordered by creation date.
+func BuildCommentThreads(comments []Comment) []*Comment {
+	byID := make(map[uint]*Comment, len(comments))
+	for i := range comments {
+		byID[comments[i].ID] = &comments[i]
+	}
+
+	roots := make([]*Comment, 0)
+	for i := range comments {
+		comment := &comments[i]
+		if comment.ParentID != nil {
+			if parent, ok := byID[*comment.ParentID]; ok {
+				parent.Replies = append(parent.Replies, comment)
+				continue
+			}
+		}
+		roots = append(roots, comment)
+	}
+	return roots
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Types of conversations
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+)
+
+// MaxConversationMembers is the size of the largest group conversation, its creator included
+const MaxConversationMembers = 10
+
+// Conversation is a chat between users outside of the events, it is stored in the "conversations" collection.
+// Its messages are stored with the ones of the events, with the ID of the conversation instead of an event.
+type Conversation struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Type      string             `bson:"type" json:"type"`
+	Name      string             `bson:"name,omitempty" json:"name,omitempty"`
+	CreatorID uint               `bson:"creator_id" json:"creator_id"`
+	MemberIDs []uint             `bson:"member_ids" json:"member_ids"`
+	// DirectKey makes the direct conversation of two users unique, it is only set on them
+	DirectKey string    `bson:"direct_key,omitempty" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// LastMessageAt sorts the conversations by activity
+	LastMessageAt time.Time `bson:"last_message_at" json:"last_message_at"`
+}
+
+// DirectConversationKey identifies the direct conversation of two users whatever the order
+func DirectConversationKey(userID, otherID uint) string {
+	if userID > otherID {
+		userID, otherID = otherID, userID
+	}
+	return fmt.Sprintf("%d:%d", userID, otherID)
+}
+
+// HasMember reports whether the user takes part in the conversation
+func (c *Conversation) HasMember(userID uint) bool {
+	for _, id := range c.MemberIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
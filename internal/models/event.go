@@ -1,6 +1,16 @@
 package models
 
-import "time"
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MaxChatRetentionDays bounds the retention chosen by the creators, about ten years,
+// a larger number of days would overflow the duration of the retention
+const MaxChatRetentionDays = 3650
 
 type Event struct {
 	ID          uint      `gorm:"primaryKey"`
@@ -9,9 +19,114 @@ type Event struct {
 	Date        time.Time `gorm:"not null"`
 	Description string    `gorm:"type:text"`
 	CreatorID   uint      `gorm:"not null"`
-	FileURL     string    `json:"file_url"`
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	// Private events and their media are only visible to the creator and the participants,
+	// the invite code is needed to join them
+	Private    bool   `gorm:"not null;default:false" json:"private"`
+	InviteCode string `gorm:"size:32" json:"invite_code,omitempty"`
+	// ChatRetentionDays is how long the chat is kept after the date of the event, the configured default is used when nil
+	// and 0 keeps it forever. ChatPurgedAt is set once the sweeper removed the messages.
+	ChatRetentionDays *int       `json:"chat_retention_days"`
+	ChatPurgedAt      *time.Time `json:"chat_purged_at,omitempty"`
+	// CancelledAt is set when the creator cancels the event, it cannot be joined nor edited anymore
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+	// Storage keys of the cover image and of its variants
+	FileKey      string `json:"-"`
+	ThumbnailKey string `json:"-"`
+	WebPKey      string `gorm:"column:webp_key" json:"-"`
+	// Signed URLs of the cover image, they are generated for each response
+	FileURL      string `gorm:"-" json:"file_url"`
+	ThumbnailURL string `gorm:"-" json:"thumbnail_url"`
+	WebPURL      string `gorm:"-" json:"webp_url"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 	// Associations
-	Users []User `gorm:"many2many:user_events;"`
+	Users  []User       `gorm:"many2many:user_events;"`
+	Images []EventImage `gorm:"foreignKey:EventID" json:"images,omitempty"`
+	// Rating is computed from the reviews, it is not persisted
+	Rating *RatingSummary `gorm:"-" json:"rating,omitempty"`
+}
+
+// CanViewEvent reports whether the user can see the event and its media
+func CanViewEvent(db *gorm.DB, event *Event, userID uint) (bool, error) {
+	if !event.Private || event.CreatorID == userID {
+		return true, nil
+	}
+	return IsEventMember(db, userID, event.ID)
+}
+
+// ChatExpiresAt returns when the chat of the event expires, false when it is kept forever
+func (e *Event) ChatExpiresAt(defaultRetention time.Duration) (time.Time, bool) {
+	retention := defaultRetention
+	if e.ChatRetentionDays != nil {
+		retention = time.Duration(min(*e.ChatRetentionDays, MaxChatRetentionDays)) * 24 * time.Hour
+	}
+	if retention <= 0 {
+		return time.Time{}, false
+	}
+	return e.Date.Add(retention), true
+}
+
+// ChatExpired reports whether the chat of the event is closed, its messages are removed or about to be
+func (e *Event) ChatExpired(defaultRetention time.Duration) bool {
+	if e.ChatPurgedAt != nil {
+		return true
+	}
+	expiresAt, ok := e.ChatExpiresAt(defaultRetention)
+	return ok && time.Now().After(expiresAt)
+}
+
+// VisibleEvents limits a query on the events to the ones the user can see
+func VisibleEvents(userID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("events.private = ? OR events.creator_id = ? OR events.id IN (?)",
+			false, userID, db.Session(&gorm.Session{NewDB: true}).Model(&UserEvent{}).Select("event_id").Where("user_id = ?", userID))
+	}
+}
+
+// BackfillEventFileKeys fills the keys of the events created when the cover was stored as a public URL,
+// the signed URLs are generated from the keys. The key is the path of the URL without the bucket.
+func BackfillEventFileKeys(db *gorm.DB, bucket string) error {
+	for urlColumn, keyColumn := range map[string]string{
+		"file_url":      "file_key",
+		"thumbnail_url": "thumbnail_key",
+		"webp_url":      "webp_key",
+	} {
+		if !db.Migrator().HasColumn(&Event{}, urlColumn) {
+			continue
+		}
+
+		var rows []struct {
+			ID  uint
+			URL string
+		}
+		err := db.Table("events").Select("id, " + urlColumn + " AS url").
+			Where(urlColumn + " <> '' AND (" + keyColumn + " IS NULL OR " + keyColumn + " = '')").Scan(&rows).Error
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			key := legacyFileKey(row.URL, bucket)
+			if key == "" {
+				continue
+			}
+			if err := db.Table("events").Where("id = ?", row.ID).Update(keyColumn, key).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// legacyFileKey extracts the key from a path style (http://localhost:4566/<bucket>/<key>)
+// or a virtual hosted style (https://<bucket>.s3.<region>.amazonaws.com/<key>) URL
+func legacyFileKey(rawURL, bucket string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if !strings.HasPrefix(parsed.Host, bucket+".") {
+		key = strings.TrimPrefix(key, bucket+"/")
+	}
+	return key
 }
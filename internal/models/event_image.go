@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+const (
+	// ImageStatusApproved images are visible in the gallery
+	ImageStatusApproved = "approved"
+	// ImageStatusPending images were contributed by attendees and wait for the creator
+	ImageStatusPending = "pending"
+	// ImageStatusProcessing images were uploaded directly to the bucket, they are hidden until their metadata
+	// is stripped and their variants are generated
+	ImageStatusProcessing = "processing"
+)
+
+type EventImage struct {
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	EventID    uint   `gorm:"not null;index" json:"event_id"`
+	UploaderID uint   `gorm:"not null" json:"uploader_id"`
+	Key        string `gorm:"size:1024;not null" json:"-"`
+	// Variants generated at upload time
+	ThumbnailKey string `gorm:"size:1024" json:"-"`
+	WebPKey      string `gorm:"column:webp_key;size:1024" json:"-"`
+	// Signed URLs of the image and of its variants, they are generated for each response
+	URL          string    `gorm:"-" json:"url"`
+	ThumbnailURL string    `gorm:"-" json:"thumbnail_url"`
+	WebPURL      string    `gorm:"-" json:"webp_url"`
+	Caption      string    `gorm:"size:500" json:"caption"`
+	Position     int       `gorm:"not null;default:0" json:"position"`
+	IsCover      bool      `gorm:"not null;default:false" json:"is_cover"`
+	Status       string    `gorm:"size:20;not null;default:approved;index" json:"status"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Keys returns the S3 keys of the image and of its variants
+func (i *EventImage) Keys() []string {
+	keys := make([]string, 0, 3)
+	for _, key := range []string{i.Key, i.ThumbnailKey, i.WebPKey} {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -2,13 +2,65 @@ package models
 
 import (
     "go.mongodb.org/mongo-driver/bson/primitive"
+    "sort"
     "time"
 )
 
 type Message struct {
-    ID        primitive.ObjectID `bson:"_id,omitempty"`
-    EventID   uint               `bson:"event_id"`
-    SenderID  uint               `bson:"sender_id"`
-    Content   string             `bson:"content"`
-    Timestamp time.Time          `bson:"timestamp"`
+    ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+    // A message belongs to the chat of an event or to a conversation
+    EventID     uint                `bson:"event_id" json:"event_id,omitempty"`
+    ConversationID *primitive.ObjectID `bson:"conversation_id,omitempty" json:"conversation_id,omitempty"`
+    SenderID    uint                `bson:"sender_id" json:"sender_id"`
+    // ClientID is chosen by the sender, a message sent again with the same ID is not saved twice
+    ClientID    string              `bson:"client_id,omitempty" json:"client_id,omitempty"`
+    Content     string              `bson:"content" json:"content"`
+    Attachments []MessageAttachment `bson:"attachments,omitempty" json:"attachments,omitempty"`
+    Timestamp   time.Time           `bson:"timestamp" json:"timestamp"`
+    // EditedAt is set when the sender changed the content, the previous versions are kept in Edits
+    EditedAt    *time.Time          `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+    Edits       []MessageEdit       `bson:"edits,omitempty" json:"-"`
+    // A deleted message keeps its place in the history without its content
+    Deleted     bool                `bson:"deleted,omitempty" json:"deleted,omitempty"`
+    DeletedBy   uint                `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+    DeletedAt   *time.Time          `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+    // Mentions are the members of the event mentioned with @name in the content
+    Mentions    []uint              `bson:"mentions,omitempty" json:"mentions,omitempty"`
+    // ReplyTo is the root of the thread of a reply, the replies are not part of the history of the chat
+    ReplyTo     *primitive.ObjectID `bson:"reply_to,omitempty" json:"reply_to,omitempty"`
+    // ReplyCount and LastReplyAt summarize the thread of a root message
+    ReplyCount  int                 `bson:"reply_count,omitempty" json:"reply_count,omitempty"`
+    LastReplyAt *time.Time          `bson:"last_reply_at,omitempty" json:"last_reply_at,omitempty"`
+    // Reactions are the users who reacted by emoji, the responses only carry the counts
+    Reactions      map[string][]uint `bson:"reactions,omitempty" json:"-"`
+    ReactionCounts map[string]int    `bson:"-" json:"reactions,omitempty"`
+    // OwnReactions are the emojis of the user who requested the message
+    OwnReactions   []string          `bson:"-" json:"own_reactions,omitempty"`
+}
+
+// CountReactions fills the counts of the reactions and the reactions of the user, 0 for none
+func (m *Message) CountReactions(userID uint) {
+    m.ReactionCounts = nil
+    m.OwnReactions = nil
+    for emoji, userIDs := range m.Reactions {
+        if len(userIDs) == 0 {
+            continue
+        }
+        if m.ReactionCounts == nil {
+            m.ReactionCounts = make(map[string]int)
+        }
+        m.ReactionCounts[emoji] = len(userIDs)
+        for _, id := range userIDs {
+            if userID != 0 && id == userID {
+                m.OwnReactions = append(m.OwnReactions, emoji)
+            }
+        }
+    }
+    sort.Strings(m.OwnReactions)
+}
+
+// MessageEdit is a previous version of the content of a message
+type MessageEdit struct {
+    Content  string    `bson:"content" json:"content"`
+    EditedAt time.Time `bson:"edited_at" json:"edited_at"`
 }
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Types of notifications
+const (
+	NotificationMention = "mention"
+)
+
+// Notification is an in-app notification of a user, it is stored in the "notifications" collection
+type Notification struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    uint               `bson:"user_id" json:"user_id"`
+	Type      string             `bson:"type" json:"type"`
+	EventID   uint               `bson:"event_id,omitempty" json:"event_id,omitempty"`
+	MessageID primitive.ObjectID `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	SenderID  uint               `bson:"sender_id,omitempty" json:"sender_id,omitempty"`
+	// Excerpt is the beginning of the message
+	Excerpt   string    `bson:"excerpt,omitempty" json:"excerpt,omitempty"`
+	Read      bool      `bson:"read" json:"read"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+
+	// ConversationID is set instead of EventID for the mentions in a conversation
+	ConversationID *primitive.ObjectID `bson:"conversation_id,omitempty" json:"conversation_id,omitempty"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Review struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	EventID   uint      `gorm:"not null;uniqueIndex:idx_reviews_event_user" json:"event_id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_reviews_event_user" json:"user_id"`
+	Rating    int       `gorm:"not null;check:rating >= 1 AND rating <= 5" json:"rating"`
+	Comment   string    `gorm:"type:text" json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RatingSummary is the aggregate of the reviews of an event or of a creator
+type RatingSummary struct {
+	Average float64 `json:"average"`
+	Count   int64   `json:"count"`
+}
+
+// GetEventRating returns the average rating of a single event
+func GetEventRating(db *gorm.DB, eventID uint) (RatingSummary, error) {
+	var summary RatingSummary
+	err := db.Model(&Review{}).
+		Select("COALESCE(AVG(rating), 0) AS average, COUNT(*) AS count").
+		Where("event_id = ?", eventID).
+		Scan(&summary).Error
+	return summary, err
+}
+
+// GetCreatorRating returns the average rating of all the events created by a user
+func GetCreatorRating(db *gorm.DB, creatorID uint) (RatingSummary, error) {
+	var summary RatingSummary
+	err := db.Model(&Review{}).
+		Select("COALESCE(AVG(reviews.rating), 0) AS average, COUNT(*) AS count").
+		Joins("JOIN events ON events.id = reviews.event_id").
+		Where("events.creator_id = ?", creatorID).
+		Scan(&summary).Error
+	return summary, err
+}
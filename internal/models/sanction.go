@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Types of chat sanctions
+const (
+	// SanctionMute prevents the user from sending and editing messages
+	SanctionMute = "mute"
+	// SanctionBan closes the chat of the event to the user
+	SanctionBan = "ban"
+)
+
+// ChatSanction is a mute or a ban of a user in the chat of an event, it is stored in the "chat_sanctions" collection.
+// A user has at most one sanction of each type by event.
+type ChatSanction struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	EventID   uint               `bson:"event_id" json:"event_id"`
+	UserID    uint               `bson:"user_id" json:"user_id"`
+	Type      string             `bson:"type" json:"type"`
+	Reason    string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	CreatedBy uint               `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	// ExpiresAt is nil for a permanent sanction, the expired sanctions are removed by a TTL index
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
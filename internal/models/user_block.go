@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// UserBlock is a user who blocked another one, they cannot talk to each other in the conversations
+type UserBlock struct {
+	UserID    uint      `gorm:"primaryKey" json:"-"`
+	BlockedID uint      `gorm:"primaryKey;index" json:"blocked_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -1,6 +1,15 @@
 package models
 
+import "gorm.io/gorm"
+
 type UserEvent struct {
     UserID  uint `gorm:"primaryKey"`
     EventID uint `gorm:"primaryKey"`
 }
+
+// IsEventMember reports whether the user has joined the event
+func IsEventMember(db *gorm.DB, userID, eventID uint) (bool, error) {
+    var count int64
+    err := db.Model(&UserEvent{}).Where("user_id = ? AND event_id = ?", userID, eventID).Count(&count).Error
+    return count > 0, err
+}
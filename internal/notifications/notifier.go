@@ -0,0 +1,69 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/IBM/sarama"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/websockets"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Email is the message published on the email topic, the mailer consuming the topic sends it
+type Email struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier stores the in-app notifications, pushes them to the sockets of the users and optionally sends them by email
+type Notifier struct {
+	collection *mongo.Collection
+	hub        *websockets.Hub
+	producer   sarama.SyncProducer
+	emailTopic string
+}
+
+// New creates a notifier, a nil producer disables the emails
+func New(collection *mongo.Collection, hub *websockets.Hub, producer sarama.SyncProducer, emailTopic string) *Notifier {
+	return &Notifier{collection: collection, hub: hub, producer: producer, emailTopic: emailTopic}
+}
+
+// Notify saves the notification and pushes it to the user room, email is nil when no email must be sent.
+// The notification is saved even when it cannot be delivered.
+func (n *Notifier) Notify(ctx context.Context, notification *models.Notification, email *Email) error {
+	if notification.ID.IsZero() {
+		notification.ID = primitive.NewObjectID()
+	}
+	if _, err := n.collection.InsertOne(ctx, notification); err != nil {
+		return fmt.Errorf("failed to save the notification: %w", err)
+	}
+
+	envelope, err := websockets.NewEnvelope(websockets.TypeNotificationCreated, notification.EventID, notification)
+	if err != nil {
+		return err
+	}
+	if err := n.hub.Publish(ctx, websockets.UserRoom(notification.UserID), envelope); err != nil {
+		return err
+	}
+
+	if email == nil || n.producer == nil {
+		return nil
+	}
+	data, err := json.Marshal(email)
+	if err != nil {
+		return err
+	}
+	_, _, err = n.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: n.emailTopic,
+		Key:   sarama.StringEncoder(email.To),
+		Value: sarama.ByteEncoder(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish the email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tokenBucketScript refills the bucket with the time elapsed since the last call and takes a token when there is one.
+// The clock of Redis is used so the replicas share the same time. It returns 1 when allowed and the wait for the next token.
+var tokenBucketScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local refill = tonumber(ARGV[2])
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated_at')
+local tokens = tonumber(bucket[1]) or burst
+local updated_at = tonumber(bucket[2]) or now
+if now > updated_at then
+  tokens = math.min(burst, tokens + (now - updated_at) / refill)
+end
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) * refill)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated_at', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * refill))
+return {allowed, wait}
+`)
+
+// TokenBucket limits the actions by key, a key gets Burst actions at once then one more every Refill
+type TokenBucket struct {
+	rdb    *redis.Client
+	prefix string
+	burst  int
+	refill time.Duration
+}
+
+// NewTokenBucket creates a limiter storing its buckets in Redis under the prefix, so every replica shares them
+func NewTokenBucket(rdb *redis.Client, prefix string, burst int, refill time.Duration) *TokenBucket {
+	return &TokenBucket{rdb: rdb, prefix: prefix, burst: burst, refill: refill}
+}
+
+// Allow takes a token of the key, it returns false with the wait for the next token when the bucket is empty.
+// A disabled limiter, without burst or refill, allows everything.
+func (b *TokenBucket) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	if b.burst <= 0 || b.refill <= 0 {
+		return true, 0, nil
+	}
+	result, err := tokenBucketScript.Run(ctx, b.rdb, []string{b.prefix + key}, b.burst, b.refill.Milliseconds()).Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to take a token: %w", err)
+	}
+	allowed, _ := result[0].(int64)
+	wait, _ := result[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestBucket(t *testing.T, burst int, refill time.Duration) (*TokenBucket, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	server.SetTime(time.Unix(1700000000, 0))
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return NewTokenBucket(rdb, "ratelimit:test:", burst, refill), server
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	type step struct {
+		key     string
+		advance time.Duration
+		allowed bool
+		wait    time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "burst then refused",
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: false, wait: time.Second},
+			},
+		},
+		{
+			name: "refill",
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", advance: 500 * time.Millisecond, allowed: false, wait: 500 * time.Millisecond},
+				{key: "a", advance: 500 * time.Millisecond, allowed: true},
+				{key: "a", allowed: false, wait: time.Second},
+			},
+		},
+		{
+			name: "refill is capped by the burst",
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", advance: time.Hour, allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: false, wait: time.Second},
+			},
+		},
+		{
+			name: "keys are independent",
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: false, wait: time.Second},
+				{key: "b", allowed: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, server := newTestBucket(t, 3, time.Second)
+			now := time.Unix(1700000000, 0)
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				server.SetTime(now)
+				allowed, wait, err := bucket.Allow(ctx, s.key)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if allowed != s.allowed || wait != s.wait {
+					t.Fatalf("step %d: got allowed %v wait %v, want %v %v", i, allowed, wait, s.allowed, s.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketDisabled(t *testing.T) {
+	for _, tt := range []struct {
+		burst  int
+		refill time.Duration
+	}{{0, time.Second}, {3, 0}} {
+		bucket, _ := newTestBucket(t, tt.burst, tt.refill)
+		for i := 0; i < 10; i++ {
+			allowed, _, err := bucket.Allow(context.Background(), "a")
+			if err != nil || !allowed {
+				t.Fatalf("burst %d refill %v: got %v %v, want allowed", tt.burst, tt.refill, allowed, err)
+			}
+		}
+	}
+}
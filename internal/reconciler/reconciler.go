@@ -0,0 +1,240 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// QuarantinePrefix is the folder where the orphans are moved instead of being deleted
+const QuarantinePrefix = "quarantine/"
+
+// ReferenceSource adds to keys the storage keys the application still references
+type ReferenceSource func(ctx context.Context, keys map[string]struct{}) error
+
+// Target is a bucket with the sources of the keys it must keep
+type Target struct {
+	Bucket  string
+	Sources []ReferenceSource
+	// KeptPrefixes are folders of objects which are never referenced and must be kept, e.g. the archives
+	KeptPrefixes []string
+}
+
+type Options struct {
+	// GracePeriod protects the objects which are being uploaded and not referenced yet
+	GracePeriod time.Duration
+	// Quarantine moves the orphans under QuarantinePrefix instead of deleting them
+	Quarantine bool
+	// QuarantineRetention is how long the quarantined objects are kept, 0 keeps them forever
+	QuarantineRetention time.Duration
+	// DryRun only reports the orphans
+	DryRun bool
+}
+
+// Report counts the objects of a bucket by outcome
+type Report struct {
+	Bucket      string
+	Scanned     int
+	Referenced  int
+	Recent      int
+	Orphaned    int
+	Deleted     int
+	Quarantined int
+	Purged      int
+	Failed      int
+}
+
+// Reconciler removes the objects of the buckets which are not referenced by the application anymore,
+// e.g. files uploaded by a request which failed afterwards or files of deleted records
+type Reconciler struct {
+	store   storage.Storage
+	targets []Target
+	options Options
+	objects metric.Int64Counter
+	runs    metric.Int64Counter
+}
+
+func New(store storage.Storage, targets []Target, options Options) (*Reconciler, error) {
+	if options.GracePeriod <= 0 {
+		return nil, errors.New("the grace period of the reconciler must be positive")
+	}
+
+	meter := otel.Meter("event-service")
+	objects, err := meter.Int64Counter("storage.reconciler.objects",
+		metric.WithDescription("Objects processed by the storage reconciler, by bucket and result"))
+	if err != nil {
+		return nil, err
+	}
+	runs, err := meter.Int64Counter("storage.reconciler.runs",
+		metric.WithDescription("Runs of the storage reconciler, by bucket and status"))
+	if err != nil {
+		return nil, err
+	}
+	return &Reconciler{store: store, targets: targets, options: options, objects: objects, runs: runs}, nil
+}
+
+// Start runs the reconciler every interval until the context is cancelled
+func (r *Reconciler) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reports, err := r.Run(ctx)
+			for _, report := range reports {
+				logger.LogMessage("info", "Storage reconciliation done", "", report.fields())
+			}
+			if err != nil {
+				logger.LogMessage("error", fmt.Sprintf("Storage reconciliation failed: %v", err), "", nil)
+			}
+		}
+	}
+}
+
+// Run reconciles every bucket once. A bucket is skipped when one of its sources fails,
+// a partial set of references would make referenced objects look orphaned.
+func (r *Reconciler) Run(ctx context.Context) ([]Report, error) {
+	var reports []Report
+	var errs []error
+	for _, target := range r.targets {
+		report, err := r.reconcile(ctx, target)
+		status := "success"
+		if err != nil {
+			status = "failure"
+			errs = append(errs, fmt.Errorf("bucket %s: %w", target.Bucket, err))
+		}
+		r.runs.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("bucket", target.Bucket),
+			attribute.String("status", status),
+		))
+		r.record(ctx, report)
+		reports = append(reports, report)
+	}
+	return reports, errors.Join(errs...)
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, target Target) (Report, error) {
+	report := Report{Bucket: target.Bucket}
+	// The deadline is taken before loading the references, an object created while the references
+	// are loaded is always more recent than the grace period
+	deadline := time.Now().Add(-r.options.GracePeriod)
+
+	referenced := make(map[string]struct{})
+	for _, source := range target.Sources {
+		if err := source(ctx, referenced); err != nil {
+			return report, fmt.Errorf("failed to load the references: %w", err)
+		}
+	}
+
+	var orphans, expired []string
+	err := r.store.List(ctx, target.Bucket, "", func(object storage.ObjectInfo) error {
+		if strings.HasPrefix(object.Key, QuarantinePrefix) {
+			if r.options.QuarantineRetention > 0 && time.Since(object.LastModified) > r.options.QuarantineRetention {
+				expired = append(expired, object.Key)
+			}
+			return nil
+		}
+		for _, prefix := range target.KeptPrefixes {
+			if strings.HasPrefix(object.Key, prefix) {
+				return nil
+			}
+		}
+
+		report.Scanned++
+		switch _, ok := referenced[object.Key]; {
+		case ok:
+			report.Referenced++
+		case object.LastModified.After(deadline):
+			report.Recent++
+		default:
+			report.Orphaned++
+			orphans = append(orphans, object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list the objects: %w", err)
+	}
+	if r.options.DryRun {
+		return report, nil
+	}
+
+	for _, key := range orphans {
+		if r.options.Quarantine {
+			if err := r.quarantine(ctx, target.Bucket, key); err != nil {
+				report.Failed++
+				logger.LogMessage("error", fmt.Sprintf("Failed to quarantine orphaned object: %v", err), "", map[string]interface{}{"bucket": target.Bucket, "key": key})
+				continue
+			}
+			report.Quarantined++
+			continue
+		}
+		if err := r.store.Delete(ctx, target.Bucket, key); err != nil {
+			report.Failed++
+			logger.LogMessage("error", fmt.Sprintf("Failed to delete orphaned object: %v", err), "", map[string]interface{}{"bucket": target.Bucket, "key": key})
+			continue
+		}
+		report.Deleted++
+	}
+
+	for _, key := range expired {
+		if err := r.store.Delete(ctx, target.Bucket, key); err != nil {
+			report.Failed++
+			logger.LogMessage("error", fmt.Sprintf("Failed to purge quarantined object: %v", err), "", map[string]interface{}{"bucket": target.Bucket, "key": key})
+			continue
+		}
+		report.Purged++
+	}
+	return report, nil
+}
+
+// quarantine moves the object under QuarantinePrefix, the copy keeps it restorable by hand
+func (r *Reconciler) quarantine(ctx context.Context, bucket, key string) error {
+	if err := r.store.Copy(ctx, bucket, key, QuarantinePrefix+key); err != nil {
+		return err
+	}
+	return r.store.Delete(ctx, bucket, key)
+}
+
+func (r *Reconciler) record(ctx context.Context, report Report) {
+	for result, count := range map[string]int{
+		"scanned":     report.Scanned,
+		"referenced":  report.Referenced,
+		"recent":      report.Recent,
+		"orphaned":    report.Orphaned,
+		"deleted":     report.Deleted,
+		"quarantined": report.Quarantined,
+		"purged":      report.Purged,
+		"failed":      report.Failed,
+	} {
+		r.objects.Add(ctx, int64(count), metric.WithAttributes(
+			attribute.String("bucket", report.Bucket),
+			attribute.String("result", result),
+			attribute.Bool("dry_run", r.options.DryRun),
+		))
+	}
+}
+
+func (report Report) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"bucket":      report.Bucket,
+		"scanned":     report.Scanned,
+		"referenced":  report.Referenced,
+		"recent":      report.Recent,
+		"orphaned":    report.Orphaned,
+		"deleted":     report.Deleted,
+		"quarantined": report.Quarantined,
+		"purged":      report.Purged,
+		"failed":      report.Failed,
+	}
+}
@@ -0,0 +1,65 @@
+package reconciler
+
+import (
+	"context"
+
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+// EventFileReferences references the cover and the gallery images of the events, with their variants
+func EventFileReferences(db *gorm.DB) ReferenceSource {
+	return func(ctx context.Context, keys map[string]struct{}) error {
+		var events []models.Event
+		err := db.WithContext(ctx).Select("id", "file_key", "thumbnail_key", "webp_key").
+			FindInBatches(&events, 1000, func(tx *gorm.DB, batch int) error {
+				for _, event := range events {
+					addKeys(keys, event.FileKey, event.ThumbnailKey, event.WebPKey)
+				}
+				return nil
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		// Pending images are referenced too, they wait for the moderation of the creator
+		var images []models.EventImage
+		return db.WithContext(ctx).Select("id", "key", "thumbnail_key", "webp_key").
+			FindInBatches(&images, 1000, func(tx *gorm.DB, batch int) error {
+				for _, image := range images {
+					addKeys(keys, image.Keys()...)
+				}
+				return nil
+			}).Error
+	}
+}
+
+func addKeys(keys map[string]struct{}, values ...string) {
+	for _, key := range values {
+		if key != "" {
+			keys[key] = struct{}{}
+		}
+	}
+}
+
+// AttachmentReferences references the chat attachments, the ones never sent expire with a TTL index
+func AttachmentReferences(collection *mongo.Collection) ReferenceSource {
+	return func(ctx context.Context, keys map[string]struct{}) error {
+		cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"key": 1, "thumbnail_key": 1}))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			var attachment models.Attachment
+			if err := cursor.Decode(&attachment); err != nil {
+				return err
+			}
+			addKeys(keys, attachment.Keys()...)
+		}
+		return cursor.Err()
+	}
+}
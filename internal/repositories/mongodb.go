@@ -5,6 +5,8 @@ import (
     "time"
 
 	"github.com/devops-360-online/go-with-me/config"
+    "github.com/devops-360-online/go-with-me/internal/models"
+    "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -24,3 +26,98 @@ func NewMongoClient(cfg *config.Config) (*mongo.Client, error) {
     }
     return client, nil
 }
+
+// EnsureChatIndexes creates the indexes of the chat collections, creating an existing index is a no-op
+func EnsureChatIndexes(ctx context.Context, db *mongo.Database) error {
+	// The history is paginated by event from the newest message, the threads by root message
+	_, err := db.Collection("messages").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "event_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "reply_to", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"reply_to": bson.M{"$exists": true}}),
+		},
+		{
+			// The search is always restricted to an event, the chats mix languages so the words are not stemmed
+			Keys:    bson.D{{Key: "event_id", Value: 1}, {Key: "content", Value: "text"}},
+			Options: options.Index().SetName("event_content_text").SetDefaultLanguage("none"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("attachments").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "event_id", Value: 1}}},
+		{
+			// The uploads which were never sent in a message expire, their files are then collected by the reconciler
+			Keys: bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().
+				SetExpireAfterSeconds(int32(models.UnattachedAttachmentTTL.Seconds())).
+				SetPartialFilterExpression(bson.M{"attached": false}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("chat_sanctions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "event_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "type", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// The temporary sanctions are removed once expired, the permanent ones have no expires_at
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// A user has a single read marker by event
+	_, err = db.Collection("chat_reads").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "event_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The messages of the conversations are paginated like the ones of the events
+	_, err = db.Collection("messages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "conversation_id", Value: 1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetPartialFilterExpression(bson.M{"conversation_id": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("conversations").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "member_ids", Value: 1}, {Key: "last_message_at", Value: -1}}},
+		{
+			// Two users have a single direct conversation
+			Keys: bson.D{{Key: "direct_key", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"direct_key": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The client IDs make the messages idempotent, they are unique by sender
+	_, err = db.Collection("messages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "sender_id", Value: 1}, {Key: "client_id", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"client_id": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The notifications are listed by user from the newest
+	_, err = db.Collection("notifications").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}},
+	})
+	return err
+}
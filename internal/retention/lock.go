@@ -0,0 +1,48 @@
+package retention
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// lockPrefix is followed by the event ID in the key locking the purge of its chat
+	lockPrefix = "chat:retention:lock:"
+	// lockTTL releases the lock of a replica which stopped during a purge
+	lockTTL = 15 * time.Minute
+)
+
+// unlockScript deletes the lock only while it is still held by the token, an expired lock may belong to another replica.
+// KEYS[1] is the lock, ARGV[1] the token.
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// lock takes the lock of the chat of the event so a single replica archives and purges it.
+// It returns the function releasing the lock, nil when another replica holds it.
+func (s *Sweeper) lock(ctx context.Context, eventID uint) (func(), error) {
+	key := fmt.Sprintf("%s%d", lockPrefix, eventID)
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(random)
+	acquired, err := s.rdb.SetNX(ctx, key, token, lockTTL).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the chat: %w", err)
+	}
+	if !acquired {
+		return nil, nil
+	}
+	return func() {
+		unlockScript.Run(context.Background(), s.rdb, []string{key}, token)
+	}, nil
+}
@@ -0,0 +1,270 @@
+package retention
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/internal/logger"
+	"github.com/devops-360-online/go-with-me/internal/models"
+	"github.com/devops-360-online/go-with-me/internal/storage"
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"gorm.io/gorm"
+)
+
+// ArchivePrefix is the folder of the chat bucket where the expired chats are archived, the reconciler keeps it
+const ArchivePrefix = "archives/"
+
+type Options struct {
+	// DefaultRetention is how long the chats are kept after the date of their event, 0 keeps them forever.
+	// The events override it with their ChatRetentionDays.
+	DefaultRetention time.Duration
+	// Archive writes the messages to the bucket as gzipped JSON lines before removing them
+	Archive bool
+	// Bucket is the chat bucket receiving the archives
+	Bucket string
+}
+
+// Report counts the chats and the messages removed by a run
+type Report struct {
+	Expired int
+	Purged  int
+	// Locked counts the chats purged by another replica during the run
+	Locked   int
+	Archived int64
+	Deleted  int64
+	Failed   int
+}
+
+// Sweeper removes the chats of the events once their retention is over: the messages, the attachments,
+// the read markers, the sanctions and the mention notifications. Every replica runs it, a Redis lock
+// by event makes sure a chat is archived and purged once.
+type Sweeper struct {
+	db      *gorm.DB
+	mongo   *mongo.Database
+	rdb     *redis.Client
+	store   storage.Storage
+	options Options
+	events  metric.Int64Counter
+}
+
+func New(db *gorm.DB, mongoDB *mongo.Database, rdb *redis.Client, store storage.Storage, options Options) (*Sweeper, error) {
+	if options.Archive && options.Bucket == "" {
+		return nil, errors.New("the bucket of the chat archives is not configured")
+	}
+
+	events, err := otel.Meter("event-service").Int64Counter("chat.retention.events",
+		metric.WithDescription("Expired event chats processed by the retention sweeper, by result"))
+	if err != nil {
+		return nil, err
+	}
+	return &Sweeper{db: db, mongo: mongoDB, rdb: rdb, store: store, options: options, events: events}, nil
+}
+
+// Start runs the sweeper every interval until the context is cancelled
+func (s *Sweeper) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.Run(ctx)
+			logger.LogMessage("info", "Chat retention sweep done", "", report.fields())
+			if err != nil {
+				logger.LogMessage("error", fmt.Sprintf("Chat retention sweep failed: %v", err), "", nil)
+			}
+		}
+	}
+}
+
+// Run purges the chats which expired since the last run. A chat which fails is left as is and retried by the next run.
+func (s *Sweeper) Run(ctx context.Context) (Report, error) {
+	var report Report
+	var events []models.Event
+	err := s.db.Select("id", "date", "chat_retention_days").
+		Where("chat_purged_at IS NULL AND date < ?", time.Now()).Find(&events).Error
+	if err != nil {
+		return report, fmt.Errorf("failed to load the events: %w", err)
+	}
+
+	var errs []error
+	for i := range events {
+		event := &events[i]
+		if !event.ChatExpired(s.options.DefaultRetention) {
+			continue
+		}
+		report.Expired++
+		archived, deleted, purged, err := s.purgeLocked(ctx, event)
+		report.Archived += archived
+		report.Deleted += deleted
+		result := "purged"
+		switch {
+		case err != nil:
+			result = "failed"
+			report.Failed++
+			errs = append(errs, fmt.Errorf("event %d: %w", event.ID, err))
+		case !purged:
+			result = "locked"
+			report.Locked++
+		default:
+			report.Purged++
+		}
+		s.events.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+	}
+	return report, errors.Join(errs...)
+}
+
+// purgeLocked purges the chat of the event under its lock, it returns false when another replica holds the lock
+// or purged the chat since the events were loaded
+func (s *Sweeper) purgeLocked(ctx context.Context, event *models.Event) (int64, int64, bool, error) {
+	unlock, err := s.lock(ctx, event.ID)
+	if err != nil || unlock == nil {
+		return 0, 0, false, err
+	}
+	defer unlock()
+
+	var pending int64
+	err = s.db.Model(&models.Event{}).Where("id = ? AND chat_purged_at IS NULL", event.ID).Count(&pending).Error
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to load the event: %w", err)
+	}
+	if pending == 0 {
+		return 0, 0, false, nil
+	}
+	archived, deleted, err := s.purge(ctx, event)
+	return archived, deleted, err == nil, err
+}
+
+// purge archives and removes the chat of the event, then marks it as purged
+func (s *Sweeper) purge(ctx context.Context, event *models.Event) (int64, int64, error) {
+	var archived int64
+	if s.options.Archive {
+		var err error
+		if archived, err = s.archive(ctx, event.ID); err != nil {
+			// Nothing is removed until the archive is stored
+			return 0, 0, fmt.Errorf("failed to archive the messages: %w", err)
+		}
+	}
+
+	filter := bson.M{"event_id": event.ID}
+	result, err := s.mongo.Collection("messages").DeleteMany(ctx, filter)
+	if err != nil {
+		return archived, 0, fmt.Errorf("failed to delete the messages: %w", err)
+	}
+	if err := s.deleteAttachments(ctx, event.ID); err != nil {
+		return archived, result.DeletedCount, err
+	}
+	for _, collection := range []string{"chat_reads", "chat_sanctions", "notifications"} {
+		if _, err := s.mongo.Collection(collection).DeleteMany(ctx, filter); err != nil {
+			return archived, result.DeletedCount, fmt.Errorf("failed to delete the %s: %w", collection, err)
+		}
+	}
+
+	if err := s.db.Model(&models.Event{}).Where("id = ?", event.ID).Update("chat_purged_at", time.Now()).Error; err != nil {
+		return archived, result.DeletedCount, fmt.Errorf("failed to mark the chat as purged: %w", err)
+	}
+	return archived, result.DeletedCount, nil
+}
+
+// deleteAttachments removes the files of the chat and their metadata,
+// the files which cannot be deleted now are collected later by the reconciler
+func (s *Sweeper) deleteAttachments(ctx context.Context, eventID uint) error {
+	collection := s.mongo.Collection("attachments")
+	cursor, err := collection.Find(ctx, bson.M{"event_id": eventID})
+	if err != nil {
+		return fmt.Errorf("failed to load the attachments: %w", err)
+	}
+	var attachments []models.Attachment
+	if err := cursor.All(ctx, &attachments); err != nil {
+		return fmt.Errorf("failed to load the attachments: %w", err)
+	}
+	for _, attachment := range attachments {
+		for _, key := range attachment.Keys() {
+			if err := s.store.Delete(ctx, s.options.Bucket, key); err != nil {
+				logger.LogMessage("error", fmt.Sprintf("Failed to delete expired attachment: %v", err), "", map[string]interface{}{"bucket": s.options.Bucket, "key": key})
+			}
+		}
+	}
+	if _, err := collection.DeleteMany(ctx, bson.M{"event_id": eventID}); err != nil {
+		return fmt.Errorf("failed to delete the attachments: %w", err)
+	}
+	return nil
+}
+
+// archive writes the messages of the event, replies and deleted ones included, to
+// archives/events/<id>/<time>.jsonl.gz with one document in relaxed extended JSON by line.
+// It returns the number of archived messages, no archive is written for an empty chat.
+func (s *Sweeper) archive(ctx context.Context, eventID uint) (int64, error) {
+	cursor, err := s.mongo.Collection("messages").Find(ctx, bson.M{"event_id": eventID},
+		options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	// The archive is spooled to a temporary file, the storage needs a seekable body and a chat can be large
+	file, err := os.CreateTemp("", "chat-archive-*.jsonl.gz")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	compressed := gzip.NewWriter(file)
+	buffered := bufio.NewWriter(compressed)
+	var count int64
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, false, false)
+		if err != nil {
+			return 0, err
+		}
+		buffered.Write(line)
+		buffered.WriteByte('\n')
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	if err := buffered.Flush(); err != nil {
+		return 0, err
+	}
+	if err := compressed.Close(); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	key := fmt.Sprintf("%sevents/%d/%s.jsonl.gz", ArchivePrefix, eventID, time.Now().UTC().Format("20060102T150405Z"))
+	if err := s.store.Put(ctx, s.options.Bucket, key, file, "application/gzip"); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (report Report) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"expired":  report.Expired,
+		"purged":   report.Purged,
+		"locked":   report.Locked,
+		"archived": report.Archived,
+		"deleted":  report.Deleted,
+		"failed":   report.Failed,
+	}
+}
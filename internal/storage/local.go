@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStorage stores the objects on the filesystem, one directory per bucket.
+// It is meant for development and tests, the files are served by the API under the public URL
+// with URLs signed with an HMAC of the signing key.
+type LocalStorage struct {
+	root       string
+	publicURL  string
+	signingKey []byte
+}
+
+func NewLocal(root, publicURL, signingKey string) (*LocalStorage, error) {
+	if root == "" {
+		return nil, errors.New("local storage requires a root directory")
+	}
+	if signingKey == "" {
+		return nil, errors.New("local storage requires a signing key")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{root: root, publicURL: strings.TrimSuffix(publicURL, "/"), signingKey: []byte(signingKey)}, nil
+}
+
+// path resolves the file of an object, refusing keys escaping the bucket directory
+func (s *LocalStorage) path(bucket, key string) (string, error) {
+	bucketDir := filepath.Join(s.root, filepath.Clean("/"+bucket))
+	path := filepath.Join(bucketDir, filepath.Clean("/"+key))
+	if path == bucketDir {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return path, nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, bucket, key string, body io.ReadSeeker, contentType string) error {
+	path, err := s.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, bucket, key string) error {
+	path, err := s.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	path, err := s.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(key)),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+func (s *LocalStorage) ReadRange(ctx context.Context, bucket, key string, offset, length int64) ([]byte, error) {
+	path, err := s.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.NewSectionReader(file, offset, length))
+}
+
+// List walks the bucket directory, the temporary files of the uploads in progress are ignored
+func (s *LocalStorage) List(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	bucketDir := filepath.Join(s.root, filepath.Clean("/"+bucket))
+	err := filepath.WalkDir(bucketDir, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && path != bucketDir {
+			// Deleted while walking the bucket
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			ContentType:  mime.TypeByExtension(filepath.Ext(key)),
+			LastModified: info.ModTime(),
+		})
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *LocalStorage) Copy(ctx context.Context, bucket, srcKey, dstKey string) error {
+	path, err := s.path(bucket, srcKey)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.Put(ctx, bucket, dstKey, file, mime.TypeByExtension(filepath.Ext(dstKey)))
+}
+
+// PresignPut is not available, the files have to be uploaded through the API
+func (s *LocalStorage) PresignPut(ctx context.Context, bucket, key, contentType string, size int64, ttl time.Duration) (*PresignedRequest, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *LocalStorage) PresignGet(ctx context.Context, bucket, key string, ttl time.Duration) (string, error) {
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", s.sign(bucket, key, expires))
+	return fmt.Sprintf("%s/%s/%s?%s", s.publicURL, url.PathEscape(bucket), escapeKey(key), query.Encode()), nil
+}
+
+// escapeKey escapes each segment of the key for a URL path, the keys built from the event names can hold any character
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (s *LocalStorage) sign(bucket, key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	fmt.Fprintf(mac, "%s/%s:%d", bucket, key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// OpenSigned opens the object of a URL returned by PresignGet once its signature was verified
+func (s *LocalStorage) OpenSigned(bucket, key, expires, signature string) (*os.File, time.Time, error) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, time.Time{}, ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(s.sign(bucket, key, expiresAt)), []byte(signature)) {
+		return nil, time.Time{}, ErrInvalidSignature
+	}
+
+	path, err := s.path(bucket, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return file, time.Unix(expiresAt, 0), nil
+}
+
+func (s *LocalStorage) EnsureBucket(ctx context.Context, bucket BucketConfig) error {
+	return os.MkdirAll(filepath.Join(s.root, filepath.Clean("/"+bucket.Name)), 0o755)
+}
+
+// MakeObjectsPrivate has nothing to do, the local files are only served with a signature
+func (s *LocalStorage) MakeObjectsPrivate(ctx context.Context, bucket string) error {
+	return nil
+}
+
+func (s *LocalStorage) Ping(ctx context.Context, bucket string) error {
+	info, err := os.Stat(filepath.Join(s.root, filepath.Clean("/"+bucket)))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", info.Name())
+	}
+	return nil
+}
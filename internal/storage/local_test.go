@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocal(t *testing.T) *LocalStorage {
+	t.Helper()
+	store, err := NewLocal(t.TempDir(), "http://api.test/media", "secret")
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	return store
+}
+
+func TestLocalStorageObjects(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocal(t)
+	const bucket = "events"
+	objects := map[string]string{
+		"events/party-1/cover.jpg":       "cover",
+		"events/party-1/cover-thumb.jpg": "thumb",
+		"events/other-2/a b#c?.png":      "special",
+		"chat/1/file.png":                "chat",
+	}
+	for key, content := range objects {
+		if err := store.Put(ctx, bucket, key, strings.NewReader(content), ""); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	t.Run("Stat", func(t *testing.T) {
+		tests := []struct {
+			key     string
+			size    int64
+			wantErr error
+		}{
+			{key: "events/party-1/cover.jpg", size: 5},
+			{key: "events/other-2/a b#c?.png", size: 7},
+			{key: "events/missing.jpg", wantErr: ErrNotFound},
+		}
+		for _, tt := range tests {
+			info, err := store.Stat(ctx, bucket, tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Stat %s: got error %v, want %v", tt.key, err, tt.wantErr)
+			}
+			if err == nil && (info.Size != tt.size || info.Key != tt.key) {
+				t.Fatalf("Stat %s: got %+v, want size %d", tt.key, info, tt.size)
+			}
+		}
+	})
+
+	t.Run("ReadRange", func(t *testing.T) {
+		tests := []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, 2, "co"},
+			{2, 10, "ver"},
+			{0, 100, "cover"},
+			{5, 10, ""},
+		}
+		for _, tt := range tests {
+			data, err := store.ReadRange(ctx, bucket, "events/party-1/cover.jpg", tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("ReadRange(%d, %d): %v", tt.offset, tt.length, err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("ReadRange(%d, %d) = %q, want %q", tt.offset, tt.length, data, tt.want)
+			}
+		}
+		if _, err := store.ReadRange(ctx, bucket, "events/missing.jpg", 0, 1); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("ReadRange of a missing object: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		tests := []struct {
+			prefix string
+			want   []string
+		}{
+			{"events/party-1/", []string{"events/party-1/cover-thumb.jpg", "events/party-1/cover.jpg"}},
+			{"events/", []string{"events/other-2/a b#c?.png", "events/party-1/cover-thumb.jpg", "events/party-1/cover.jpg"}},
+			{"chat/", []string{"chat/1/file.png"}},
+			{"missing/", nil},
+		}
+		for _, tt := range tests {
+			var keys []string
+			err := store.List(ctx, bucket, tt.prefix, func(info ObjectInfo) error {
+				keys = append(keys, info.Key)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("List %q: %v", tt.prefix, err)
+			}
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("List %q = %v, want %v", tt.prefix, keys, tt.want)
+			}
+		}
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		if err := store.Copy(ctx, bucket, "events/party-1/cover.jpg", "quarantine/cover.jpg"); err != nil {
+			t.Fatalf("Copy: %v", err)
+		}
+		data, err := store.ReadRange(ctx, bucket, "quarantine/cover.jpg", 0, 100)
+		if err != nil || string(data) != "cover" {
+			t.Fatalf("copied object = %q, %v", data, err)
+		}
+		if err := store.Copy(ctx, bucket, "events/missing.jpg", "quarantine/missing.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Copy of a missing object: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		for _, key := range []string{"events/party-1/cover.jpg", "events/missing.jpg"} {
+			if err := store.Delete(ctx, bucket, key); err != nil {
+				t.Fatalf("Delete %s: %v", key, err)
+			}
+		}
+		if _, err := store.Stat(ctx, bucket, "events/party-1/cover.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Stat of a deleted object: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestLocalStorageRejectsEscapingKeys(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocal(t)
+	if err := store.Put(ctx, "events", "../chat/file.png", strings.NewReader("x"), ""); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// The key is resolved inside the bucket
+	if _, err := store.Stat(ctx, "chat", "file.png"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("the key escaped its bucket: %v", err)
+	}
+	if err := store.Put(ctx, "events", "/", strings.NewReader("x"), ""); err == nil {
+		t.Fatalf("Put of the bucket itself succeeded")
+	}
+}
+
+// signedParts splits a URL returned by PresignGet in the bucket, the key, the expiry and the signature,
+// like the router does before calling OpenSigned
+func signedParts(t *testing.T, signed string) (string, string, string, string) {
+	t.Helper()
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("parse %s: %v", signed, err)
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(parsed.Path, "/media/"), "/")
+	return bucket, key, parsed.Query().Get("expires"), parsed.Query().Get("signature")
+}
+
+func TestLocalStorageSignedURLs(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocal(t)
+	keys := []string{"events/party-1/cover.jpg", "events/my party #1?/100% fun.png"}
+	for _, key := range keys {
+		if err := store.Put(ctx, "events", key, bytes.NewReader([]byte("image")), ""); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	for _, key := range keys {
+		signed, err := store.PresignGet(ctx, "events", key, time.Minute)
+		if err != nil {
+			t.Fatalf("PresignGet %s: %v", key, err)
+		}
+		bucket, gotKey, expires, signature := signedParts(t, signed)
+		if gotKey != key {
+			t.Fatalf("the URL %s holds the key %q, want %q", signed, gotKey, key)
+		}
+
+		tests := []struct {
+			name                    string
+			key, expires, signature string
+			wantErr                 error
+		}{
+			{name: "valid", key: gotKey, expires: expires, signature: signature},
+			{name: "expired", key: gotKey, expires: strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10), signature: signature, wantErr: ErrInvalidSignature},
+			{name: "extended expiry", key: gotKey, expires: strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10), signature: signature, wantErr: ErrInvalidSignature},
+			{name: "invalid expiry", key: gotKey, expires: "soon", signature: signature, wantErr: ErrInvalidSignature},
+			{name: "tampered signature", key: gotKey, expires: expires, signature: strings.Repeat("0", len(signature)), wantErr: ErrInvalidSignature},
+			{name: "other key", key: "events/party-1/other.jpg", expires: expires, signature: signature, wantErr: ErrInvalidSignature},
+		}
+		for _, tt := range tests {
+			t.Run(key+"/"+tt.name, func(t *testing.T) {
+				file, _, err := store.OpenSigned(bucket, tt.key, tt.expires, tt.signature)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("OpenSigned: got %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				defer file.Close()
+				data, _ := io.ReadAll(file)
+				if string(data) != "image" {
+					t.Fatalf("OpenSigned read %q", data)
+				}
+			})
+		}
+	}
+}
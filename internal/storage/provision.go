@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/devops-360-online/go-with-me/config"
+)
+
+// BucketConfig describes how a bucket is provisioned
+type BucketConfig struct {
+	Name string
+	// CORSOrigins and CORSMethods are allowed to reach the bucket from a browser
+	CORSOrigins []string
+	CORSMethods []string
+	// AbortIncompleteUploadsDays cleans the multipart uploads which were never completed
+	AbortIncompleteUploadsDays int64
+}
+
+// Buckets returns the buckets used by the service
+func Buckets(cfg *config.Config) []BucketConfig {
+	return []BucketConfig{
+		{
+			Name:                       cfg.S3BucketNameEvents,
+			CORSOrigins:                cfg.StorageCORSOrigins,
+			CORSMethods:                []string{"GET", "HEAD", "PUT"}, // PUT for the presigned uploads
+			AbortIncompleteUploadsDays: 1,
+		},
+		{
+			Name:                       cfg.S3BucketNameChatEvent,
+			CORSOrigins:                cfg.StorageCORSOrigins,
+			CORSMethods:                []string{"GET", "HEAD"},
+			AbortIncompleteUploadsDays: 1,
+		},
+	}
+}
+
+// EnsureBuckets provisions every bucket of the service
+func EnsureBuckets(ctx context.Context, store Storage, buckets []BucketConfig) error {
+	for _, bucket := range buckets {
+		if err := store.EnsureBucket(ctx, bucket); err != nil {
+			return fmt.Errorf("failed to provision bucket %s: %w", bucket.Name, err)
+		}
+	}
+	return nil
+}
+
+// MakeBucketsPrivate removes the public access of the objects of every bucket of the service
+func MakeBucketsPrivate(ctx context.Context, store Storage, buckets []BucketConfig) error {
+	for _, bucket := range buckets {
+		if err := store.MakeObjectsPrivate(ctx, bucket.Name); err != nil {
+			return fmt.Errorf("failed to make the objects of bucket %s private: %w", bucket.Name, err)
+		}
+	}
+	return nil
+}
+
+// PingBuckets checks every bucket of the service is reachable
+func PingBuckets(ctx context.Context, store Storage, buckets []BucketConfig) error {
+	for _, bucket := range buckets {
+		if err := store.Ping(ctx, bucket.Name); err != nil {
+			return fmt.Errorf("bucket %s is not reachable: %w", bucket.Name, err)
+		}
+	}
+	return nil
+}
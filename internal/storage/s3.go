@@ -0,0 +1,475 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/devops-360-online/go-with-me/config"
+)
+
+// S3Storage stores the objects in AWS S3 or in any S3 compatible service (LocalStack, GCS interoperability)
+type S3Storage struct {
+	client *s3.S3
+	// presignClient signs the URLs with the public endpoint, which can differ from the one the API uses
+	presignClient *s3.S3
+	region        string
+}
+
+// NewS3 creates the S3 backend. With a custom endpoint (LocalStack) the objects are addressed in path style
+// and the signed URLs use StoragePublicURL, falling back to the endpoint itself.
+func NewS3(cfg *config.Config) (*S3Storage, error) {
+	client, err := newS3Client(cfg.S3Region, cfg.S3Endpoint, cfg.AwsAccessKeyID, cfg.AwsSecretAccessKey)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &S3Storage{client: client, presignClient: client, region: cfg.S3Region}
+	if cfg.StoragePublicURL != "" && cfg.StoragePublicURL != cfg.S3Endpoint {
+		storage.presignClient, err = newS3Client(cfg.S3Region, cfg.StoragePublicURL, cfg.AwsAccessKeyID, cfg.AwsSecretAccessKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return storage, nil
+}
+
+// GCSStorage stores the objects in Google Cloud Storage. It goes through the XML API of GCS, which is S3 compatible,
+// authenticated with the HMAC keys of a service account.
+type GCSStorage struct {
+	*S3Storage
+}
+
+func NewGCS(cfg *config.Config) (*GCSStorage, error) {
+	client, err := newS3Client("auto", "https://storage.googleapis.com", cfg.GCSAccessKeyID, cfg.GCSSecretAccessKey)
+	if err != nil {
+		return nil, err
+	}
+	return &GCSStorage{&S3Storage{client: client, presignClient: client, region: "auto"}}, nil
+}
+
+// EnsureBucket only checks the bucket exists, the XML API cannot create a bucket without a project
+// and GCS uses IAM instead of bucket policies. The buckets are managed with gcloud or terraform.
+func (s *GCSStorage) EnsureBucket(ctx context.Context, bucket BucketConfig) error {
+	if err := s.Ping(ctx, bucket.Name); err != nil {
+		return fmt.Errorf("the bucket must be created in the GCS project: %w", err)
+	}
+	return nil
+}
+
+// MakeObjectsPrivate has nothing to do, the access to the GCS buckets is managed with IAM
+func (s *GCSStorage) MakeObjectsPrivate(ctx context.Context, bucket string) error {
+	return nil
+}
+
+func newS3Client(region, endpoint, accessKeyID, secretAccessKey string) (*s3.S3, error) {
+	awsConfig := &aws.Config{
+		Region:      aws.String(region),
+		Credentials: credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
+	}
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)   // Use the custom endpoint for LocalStack or GCS
+		awsConfig.S3ForcePathStyle = aws.Bool(true) // Force path-style URLs for LocalStack compatibility
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, bucket, key string, body io.ReadSeeker, contentType string) error {
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3Storage) Delete(ctx context.Context, bucket, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Storage) Stat(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(head.ContentLength),
+		ContentType:  aws.StringValue(head.ContentType),
+		LastModified: aws.TimeValue(head.LastModified),
+	}, nil
+}
+
+func (s *S3Storage) ReadRange(ctx context.Context, bucket, key string, offset, length int64) ([]byte, error) {
+	object, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	defer object.Body.Close()
+	return io.ReadAll(io.LimitReader(object.Body, length))
+}
+
+func (s *S3Storage) List(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	var fnErr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			fnErr = fn(ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return translateS3Error(err)
+}
+
+func (s *S3Storage) Copy(ctx context.Context, bucket, srcKey, dstKey string) error {
+	_, err := s.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(bucket + "/" + url.PathEscape(srcKey)),
+	})
+	return translateS3Error(err)
+}
+
+func (s *S3Storage) PresignPut(ctx context.Context, bucket, key, contentType string, size int64, ttl time.Duration) (*PresignedRequest, error) {
+	// The content type and the length are signed, the client must send them as returned
+	req, _ := s.presignClient.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	})
+	req.SetContext(ctx)
+	url, headers, err := req.PresignRequest(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	presigned := &PresignedRequest{Method: http.MethodPut, URL: url, Headers: make(map[string]string, len(headers))}
+	for name := range headers {
+		presigned.Headers[name] = headers.Get(name)
+	}
+	return presigned, nil
+}
+
+func (s *S3Storage) PresignGet(ctx context.Context, bucket, key string, ttl time.Duration) (string, error) {
+	req, _ := s.presignClient.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		// Let the browsers cache the object as long as the URL is valid
+		ResponseCacheControl: aws.String(fmt.Sprintf("private, max-age=%d", int(ttl.Seconds()))),
+	})
+	req.SetContext(ctx)
+	return req.Presign(ttl)
+}
+
+func (s *S3Storage) EnsureBucket(ctx context.Context, bucket BucketConfig) error {
+	err := s.Ping(ctx, bucket.Name)
+	if errors.Is(err, ErrNotFound) {
+		input := &s3.CreateBucketInput{Bucket: aws.String(bucket.Name)}
+		// us-east-1 is the default location and cannot be set explicitly
+		if s.region != "" && s.region != "us-east-1" {
+			input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(s.region)}
+		}
+		if _, err := s.client.CreateBucketWithContext(ctx, input); err != nil {
+			var awsErr awserr.Error
+			if !errors.As(err, &awsErr) || awsErr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// The objects are private, drop the public statements left on the bucket
+	if err := s.removePublicReadPolicy(ctx, bucket.Name); err != nil {
+		return err
+	}
+
+	if len(bucket.CORSOrigins) > 0 {
+		_, err := s.client.PutBucketCorsWithContext(ctx, &s3.PutBucketCorsInput{
+			Bucket: aws.String(bucket.Name),
+			CORSConfiguration: &s3.CORSConfiguration{
+				CORSRules: []*s3.CORSRule{{
+					AllowedOrigins: aws.StringSlice(bucket.CORSOrigins),
+					AllowedMethods: aws.StringSlice(bucket.CORSMethods),
+					AllowedHeaders: aws.StringSlice([]string{"*"}),
+					ExposeHeaders:  aws.StringSlice([]string{"ETag"}),
+					MaxAgeSeconds:  aws.Int64(3600),
+				}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply the CORS rules: %w", err)
+		}
+	}
+
+	if bucket.AbortIncompleteUploadsDays > 0 {
+		if err := s.applyLifecycleRule(ctx, bucket.Name, &s3.LifecycleRule{
+			ID:     aws.String(abortIncompleteUploadsRule),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+			AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: aws.Int64(bucket.AbortIncompleteUploadsDays),
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to apply the lifecycle rules: %w", err)
+		}
+	}
+	return nil
+}
+
+// abortIncompleteUploadsRule is the ID of the lifecycle rule of the service, the other rules of the bucket are kept
+const abortIncompleteUploadsRule = "abort-incomplete-uploads"
+
+// applyLifecycleRule adds the rule to the lifecycle configuration of the bucket or replaces the rule with its ID,
+// the configuration is only written when the rule changed
+func (s *S3Storage) applyLifecycleRule(ctx context.Context, bucket string, rule *s3.LifecycleRule) error {
+	var rules []*s3.LifecycleRule
+	current, err := s.client.GetBucketLifecycleConfigurationWithContext(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		rules = current.Rules
+	} else {
+		var awsErr awserr.Error
+		if !errors.As(err, &awsErr) || awsErr.Code() != "NoSuchLifecycleConfiguration" {
+			return err
+		}
+	}
+
+	merged := []*s3.LifecycleRule{rule}
+	for _, existing := range rules {
+		if aws.StringValue(existing.ID) != aws.StringValue(rule.ID) {
+			merged = append(merged, existing)
+			continue
+		}
+		if aws.StringValue(existing.Status) == aws.StringValue(rule.Status) &&
+			existing.AbortIncompleteMultipartUpload != nil &&
+			aws.Int64Value(existing.AbortIncompleteMultipartUpload.DaysAfterInitiation) == aws.Int64Value(rule.AbortIncompleteMultipartUpload.DaysAfterInitiation) {
+			return nil
+		}
+	}
+	_, err = s.client.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: merged},
+	})
+	return err
+}
+
+// removePublicReadPolicy removes the statements of the bucket policy granting anonymous reads, the policy
+// is deleted when nothing else is left and untouched when it grants no public read
+func (s *S3Storage) removePublicReadPolicy(ctx context.Context, bucket string) error {
+	output, err := s.client.GetBucketPolicyWithContext(ctx, &s3.GetBucketPolicyInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == "NoSuchBucketPolicy" {
+			return nil
+		}
+		return fmt.Errorf("failed to read the bucket policy: %w", err)
+	}
+	policy, changed, err := withoutPublicRead(aws.StringValue(output.Policy))
+	if err != nil {
+		return fmt.Errorf("failed to read the bucket policy: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+	if policy == "" {
+		_, err = s.client.DeleteBucketPolicyWithContext(ctx, &s3.DeleteBucketPolicyInput{Bucket: aws.String(bucket)})
+	} else {
+		_, err = s.client.PutBucketPolicyWithContext(ctx, &s3.PutBucketPolicyInput{Bucket: aws.String(bucket), Policy: aws.String(policy)})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove the public bucket policy: %w", err)
+	}
+	return nil
+}
+
+// withoutPublicRead returns the policy without its statements allowing anyone to get the objects, and whether
+// there were any. The policy is empty when no statement is left.
+func withoutPublicRead(policy string) (string, bool, error) {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(policy), &document); err != nil {
+		return "", false, err
+	}
+	// A policy with a single statement may not wrap it in an array
+	var statements []json.RawMessage
+	if err := json.Unmarshal(document["Statement"], &statements); err != nil {
+		statements = []json.RawMessage{document["Statement"]}
+	}
+
+	kept := make([]json.RawMessage, 0, len(statements))
+	for _, raw := range statements {
+		var statement struct {
+			Effect    string
+			Principal json.RawMessage
+			Action    json.RawMessage
+		}
+		if err := json.Unmarshal(raw, &statement); err != nil {
+			return "", false, err
+		}
+		if statement.Effect == "Allow" && anonymousPrincipal(statement.Principal) && readsObjects(statement.Action) {
+			continue
+		}
+		kept = append(kept, raw)
+	}
+	if len(kept) == len(statements) {
+		return policy, false, nil
+	}
+	if len(kept) == 0 {
+		return "", true, nil
+	}
+	document["Statement"], _ = json.Marshal(kept)
+	data, err := json.Marshal(document)
+	return string(data), true, err
+}
+
+// anonymousPrincipal reports whether the principal of a statement is "*" or {"AWS": "*"}
+func anonymousPrincipal(principal json.RawMessage) bool {
+	var value string
+	if json.Unmarshal(principal, &value) == nil {
+		return value == "*"
+	}
+	var principals map[string]json.RawMessage
+	if json.Unmarshal(principal, &principals) != nil {
+		return false
+	}
+	for _, value := range stringOrList(principals["AWS"]) {
+		if value == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// readsObjects reports whether the actions of a statement include s3:GetObject
+func readsObjects(action json.RawMessage) bool {
+	for _, value := range stringOrList(action) {
+		switch strings.ToLower(value) {
+		case "*", "s3:*", "s3:get*", "s3:getobject":
+			return true
+		}
+	}
+	return false
+}
+
+// stringOrList decodes a policy element which is a string or a list of strings
+func stringOrList(raw json.RawMessage) []string {
+	var value string
+	if json.Unmarshal(raw, &value) == nil {
+		return []string{value}
+	}
+	var values []string
+	json.Unmarshal(raw, &values)
+	return values
+}
+
+// privateObjectsTag is set on the buckets whose objects were made private
+const privateObjectsTag = "go-with-me:private-objects"
+
+// MakeObjectsPrivate sets the private ACL on every object of the bucket, the objects uploaded before
+// the media were served through signed URLs were public-read. The bucket is tagged once it is done.
+func (s *S3Storage) MakeObjectsPrivate(ctx context.Context, bucket string) error {
+	var tags []*s3.Tag
+	tagging, err := s.client.GetBucketTaggingWithContext(ctx, &s3.GetBucketTaggingInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		tags = tagging.TagSet
+	} else {
+		var awsErr awserr.Error
+		if !errors.As(err, &awsErr) || awsErr.Code() != "NoSuchTagSet" {
+			return fmt.Errorf("failed to read the bucket tags: %w", err)
+		}
+	}
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == privateObjectsTag {
+			return nil
+		}
+	}
+
+	err = s.List(ctx, bucket, "", func(object ObjectInfo) error {
+		_, err := s.client.PutObjectAclWithContext(ctx, &s3.PutObjectAclInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(object.Key),
+			ACL:    aws.String(s3.ObjectCannedACLPrivate),
+		})
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == "AccessControlListNotSupported" {
+			// The ACLs are disabled on the bucket, its objects cannot be public through them
+			return errACLsDisabled
+		}
+		if err != nil && !errors.Is(translateS3Error(err), ErrNotFound) {
+			return fmt.Errorf("failed to make %s private: %w", object.Key, err)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errACLsDisabled) {
+		return err
+	}
+
+	tags = append(tags, &s3.Tag{Key: aws.String(privateObjectsTag), Value: aws.String("true")})
+	_, err = s.client.PutBucketTaggingWithContext(ctx, &s3.PutBucketTaggingInput{
+		Bucket:  aws.String(bucket),
+		Tagging: &s3.Tagging{TagSet: tags},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to tag the bucket: %w", err)
+	}
+	return nil
+}
+
+// errACLsDisabled stops the migration of a bucket which does not use the ACLs
+var errACLsDisabled = errors.New("the ACLs are disabled on the bucket")
+
+func (s *S3Storage) Ping(ctx context.Context, bucket string) error {
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	return translateS3Error(err)
+}
+
+// translateS3Error maps the missing objects to ErrNotFound
+func translateS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestWithoutPublicRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		changed bool
+		kept    int
+	}{
+		{
+			name:    "public read",
+			policy:  `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:GetObject","Resource":"arn:aws:s3:::events/*"}]}`,
+			changed: true,
+		},
+		{
+			name:    "single statement with an AWS principal",
+			policy:  `{"Statement":{"Effect":"Allow","Principal":{"AWS":["*"]},"Action":["s3:ListBucket","s3:Get*"],"Resource":"*"}}`,
+			changed: true,
+		},
+		{
+			name:    "public read among other statements",
+			policy:  `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:*","Resource":"*"},{"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::1:role/backup"},"Action":"s3:GetObject","Resource":"*"}]}`,
+			changed: true,
+			kept:    1,
+		},
+		{
+			name:   "account principal",
+			policy: `{"Statement":[{"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::1:role/backup"},"Action":"s3:GetObject","Resource":"*"}]}`,
+			kept:   1,
+		},
+		{
+			name:   "public deny",
+			policy: `{"Statement":[{"Effect":"Deny","Principal":"*","Action":"s3:GetObject","Resource":"*","Condition":{"Bool":{"aws:SecureTransport":"false"}}}]}`,
+			kept:   1,
+		},
+		{
+			name:   "public write only",
+			policy: `{"Statement":[{"Effect":"Allow","Principal":"*","Action":"s3:PutObject","Resource":"*"}]}`,
+			kept:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, changed, err := withoutPublicRead(tt.policy)
+			if err != nil {
+				t.Fatalf("withoutPublicRead: %v", err)
+			}
+			if changed != tt.changed {
+				t.Fatalf("changed = %v, want %v", changed, tt.changed)
+			}
+			if tt.kept == 0 {
+				if policy != "" {
+					t.Fatalf("policy = %s, want none", policy)
+				}
+				return
+			}
+			var document struct {
+				Statement []json.RawMessage
+			}
+			if err := json.Unmarshal([]byte(policy), &document); err != nil {
+				t.Fatalf("decode %s: %v", policy, err)
+			}
+			if len(document.Statement) != tt.kept {
+				t.Fatalf("policy %s keeps %d statements, want %d", policy, len(document.Statement), tt.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/devops-360-online/go-with-me/config"
+)
+
+var (
+	ErrNotFound         = errors.New("object not found")
+	ErrNotSupported     = errors.New("operation not supported by the storage backend")
+	ErrInvalidSignature = errors.New("invalid or expired signature")
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// PresignedRequest is a request the client can send to the backend without credentials
+type PresignedRequest struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+}
+
+// Storage is the object storage used for the event images and the chat files.
+// The objects are private, they are downloaded through short-lived signed URLs.
+type Storage interface {
+	// Put stores the body under the key, replacing any existing object
+	Put(ctx context.Context, bucket, key string, body io.ReadSeeker, contentType string) error
+	// Delete removes the object, deleting a missing object is not an error
+	Delete(ctx context.Context, bucket, key string) error
+	// Stat returns the metadata of the object or ErrNotFound
+	Stat(ctx context.Context, bucket, key string) (*ObjectInfo, error)
+	// ReadRange returns at most length bytes of the object starting at offset
+	ReadRange(ctx context.Context, bucket, key string, offset, length int64) ([]byte, error)
+	// List calls fn for every object whose key starts with prefix, it stops at the first error returned by fn
+	List(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error
+	// Copy duplicates the object under another key of the same bucket
+	Copy(ctx context.Context, bucket, srcKey, dstKey string) error
+	// PresignPut returns a request uploading the object directly to the backend
+	PresignPut(ctx context.Context, bucket, key, contentType string, size int64, ttl time.Duration) (*PresignedRequest, error)
+	// PresignGet returns a URL downloading the object until the ttl expires
+	PresignGet(ctx context.Context, bucket, key string, ttl time.Duration) (string, error)
+	// EnsureBucket creates the bucket when it does not exist and applies its settings
+	EnsureBucket(ctx context.Context, bucket BucketConfig) error
+	// MakeObjectsPrivate removes the public access of the objects stored before the media were private.
+	// It runs once by bucket, the next calls return at once.
+	MakeObjectsPrivate(ctx context.Context, bucket string) error
+	// Ping checks the backend is reachable and the bucket exists
+	Ping(ctx context.Context, bucket string) error
+}
+
+// New creates the storage backend selected by the configuration, the client is meant to be shared
+func New(cfg *config.Config) (Storage, error) {
+	switch cfg.StorageDriver {
+	case "", "s3":
+		return NewS3(cfg)
+	case "gcs":
+		return NewGCS(cfg)
+	case "local":
+		// The API serves the files under /media unless they are exposed elsewhere
+		publicURL := cfg.StoragePublicURL
+		if publicURL == "" {
+			publicURL = "/media"
+		}
+		return NewLocal(cfg.StorageLocalPath, publicURL, cfg.MediaSigningKey)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
+	}
+}
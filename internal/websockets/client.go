@@ -0,0 +1,272 @@
+package websockets
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait is the time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+	// pongWait is the time allowed to read the next pong message from the peer
+	pongWait = 60 * time.Second
+	// pingPeriod sends the pings before the peer reaches pongWait
+	pingPeriod = pongWait * 9 / 10
+	// maxMessageSize is the maximum size of a message read from the peer
+	maxMessageSize = 64 << 10
+	// sendBufferSize is the number of messages queued for a client before it is evicted
+	sendBufferSize = 64
+)
+
+// Client is a socket or an event stream of a room. The messages are queued and written by a single goroutine,
+// WritePump or StreamPump, a client which does not read its messages fast enough is disconnected.
+type Client struct {
+	id     string
+	conn   *websocket.Conn
+	room   string
+	userID uint
+	send   chan []byte
+
+	closeOnce   sync.Once
+	done        chan struct{}
+	closeCode   int
+	closeReason string
+	expiry      *time.Timer
+
+	// held queues the envelopes received while a resume replays the missed ones, holding tells whether it is in progress
+	heldMu  sync.Mutex
+	holding bool
+	held    [][]byte
+}
+
+// NewClient wraps the connection of a user in a room, the reads fail when the peer stops answering the pings
+func NewClient(conn *websocket.Conn, room string, userID uint) *Client {
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Client{
+		id:     hex.EncodeToString(id),
+		conn:   conn,
+		room:   room,
+		userID: userID,
+		send:   make(chan []byte, sendBufferSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// NewStreamClient creates a client of a room without socket, its messages are written as server-sent events by StreamPump
+func NewStreamClient(room string, userID uint) *Client {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Client{
+		id:     hex.EncodeToString(id),
+		room:   room,
+		userID: userID,
+		send:   make(chan []byte, sendBufferSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// ID identifies the socket
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Done is closed when the client is closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Room returns the room of the client
+func (c *Client) Room() string {
+	return c.room
+}
+
+// UserID returns the user connected with the socket
+func (c *Client) UserID() uint {
+	return c.userID
+}
+
+// ReadJSON reads the next message of the peer, only the goroutine handling the socket may call it
+func (c *Client) ReadJSON(v interface{}) error {
+	return c.conn.ReadJSON(v)
+}
+
+// Send queues the data for the peer, the client is evicted when its buffer is full
+func (c *Client) Send(data []byte) bool {
+	c.heldMu.Lock()
+	if c.holding {
+		defer c.heldMu.Unlock()
+		if len(c.held) >= sendBufferSize {
+			log.Println("Evicting slow websocket client of room", c.room)
+			c.close(websocket.CloseTryAgainLater, "slow consumer")
+			return false
+		}
+		c.held = append(c.held, data)
+		return true
+	}
+	c.heldMu.Unlock()
+	return c.enqueue(data)
+}
+
+// hold keeps the data sent to the client until release
+func (c *Client) hold() {
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+	c.holding = true
+}
+
+// release queues the held data, except the envelopes up to lastID which were already replayed
+func (c *Client) release(lastID string) {
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+	for _, data := range c.held {
+		if !replayed(data, lastID) {
+			c.enqueue(data)
+		}
+	}
+	c.holding = false
+	c.held = nil
+}
+
+// push queues the data, waiting for the write pump instead of evicting the client, it is used for the replays
+func (c *Client) push(data []byte) bool {
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// enqueue writes the data in the buffer of the write pump
+func (c *Client) enqueue(data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- data:
+		return true
+	default:
+		log.Println("Evicting slow websocket client of room", c.room)
+		c.close(websocket.CloseTryAgainLater, "slow consumer")
+		return false
+	}
+}
+
+// SendJSON encodes the value and queues it for the peer
+func (c *Client) SendJSON(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Websocket encoding error:", err)
+		return false
+	}
+	return c.Send(data)
+}
+
+// ExpireAt disconnects the peer when its credentials expire, it must be called before WritePump
+func (c *Client) ExpireAt(t time.Time) {
+	c.expiry = time.AfterFunc(time.Until(t), func() {
+		c.close(websocket.ClosePolicyViolation, "token expired")
+	})
+}
+
+// Close disconnects the peer
+func (c *Client) Close() {
+	c.close(websocket.CloseNormalClosure, "")
+}
+
+// close stops the write pump, the first reason wins
+func (c *Client) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
+		close(c.done)
+	})
+}
+
+// WritePump writes the queued messages and the pings until the client is closed or a write fails
+func (c *Client) WritePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			if c.closeCode != websocket.CloseAbnormalClosure {
+				message := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+			}
+			return
+		}
+	}
+}
+
+// StreamPump writes the queued messages as server-sent events until the client is closed or a write fails.
+// The envelopes with an ID are sent with it so the browsers resume from the last one with Last-Event-ID.
+// Comments keep the connection alive through the proxies.
+func (c *Client) StreamPump(w io.Writer, flush func()) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case data := <-c.send:
+			var envelope struct {
+				ID string `json:"id"`
+			}
+			if json.Unmarshal(data, &envelope) == nil && envelope.ID != "" {
+				_, err = fmt.Fprintf(w, "id: %s\n", envelope.ID)
+			}
+			if err == nil {
+				_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+			}
+		case <-ticker.C:
+			_, err = io.WriteString(w, ": ping\n\n")
+		case <-c.done:
+			// The browsers reconnect when the stream ends, the reason tells them when they should not
+			if c.closeCode != websocket.CloseAbnormalClosure && c.closeReason != "" {
+				data, _ := json.Marshal(map[string]interface{}{"code": c.closeCode, "reason": c.closeReason})
+				fmt.Fprintf(w, "event: close\ndata: %s\n\n", data)
+				flush()
+			}
+			return
+		}
+		if err != nil {
+			c.close(websocket.CloseAbnormalClosure, "")
+			return
+		}
+		flush()
+	}
+}
@@ -1,70 +1,260 @@
 package websockets
 
 import (
-    "context"
-    "github.com/gorilla/websocket"
-    "github.com/go-redis/redis/v8"
-    "log"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// Types of the envelopes
+const (
+	TypeChatMessage     = "chat.message"
+	TypeMemberJoined    = "chat.member_joined"
+	TypeMemberRemoved   = "chat.member_removed"
+	TypeMessageEdited   = "chat.message_edited"
+	TypeMessageDeleted  = "chat.message_deleted"
+	TypeUserMuted       = "chat.user_muted"
+	TypeUserBanned      = "chat.user_banned"
+	TypeSanctionLifted  = "chat.sanction_lifted"
+	TypeReactionAdded   = "chat.reaction_added"
+	TypeReactionRemoved = "chat.reaction_removed"
+	TypeMessageRead     = "chat.read"
+	// Envelopes of the changes of the events, sent to the viewers and to the chat
+	TypeEventUpdated     = "event.updated"
+	TypeEventCancelled   = "event.cancelled"
+	TypeAttendeesChanged = "event.attendees"
+	// Envelopes of the user rooms
+	TypeUnreadState         = "unread.state"
+	TypeUnreadMessage       = "unread.message"
+	TypeUnreadUpdated       = "unread.updated"
+	TypeNotificationCreated = "notification.created"
+	// TypeSystem is only sent to the socket it concerns
+	TypeSystem = "chat.system"
+	// Ephemeral envelopes, they are never persisted
+	TypePresenceState  = "presence.state"
+	TypePresenceJoined = "presence.joined"
+	TypePresenceLeft   = "presence.left"
+	TypeTypingStarted  = "typing.started"
+	TypeTypingStopped  = "typing.stopped"
 )
 
-type Client struct {
-    Conn    *websocket.Conn
-    EventID string
-}
-
-var clients = make(map[*Client]bool)
-var register = make(chan *Client)
-var unregister = make(chan *Client)
-var redisClient *redis.Client
-var mu sync.Mutex
-
-func RunHub(rdb *redis.Client) {
-    redisClient = rdb
-    go subscribeToRedis()
-    for {
-        select {
-        case client := <-register:
-            clients[client] = true
-        case client := <-unregister:
-            if _, ok := clients[client]; ok {
-                delete(clients, client)
-                client.Conn.Close()
-            }
-        }
-    }
-}
-
-func subscribeToRedis() {
-    pubsub := redisClient.Subscribe(context.Background(), "chat_messages")
-    defer pubsub.Close()
-    for {
-        msg, err := pubsub.ReceiveMessage(context.Background())
-        if err != nil {
-            log.Println("Redis subscribe error:", err)
-            continue
-        }
-        // Broadcast the message to all clients
-        for client := range clients {
-            // Filter clients by EventID
-            if client.EventID == msg.Channel {
-                client.Conn.WriteJSON(msg.Payload)
-            }
-        }
-    }
-}
-
-func RegisterClient(client *Client) {
-    mu.Lock()
-    defer mu.Unlock()
-    clients[client] = true
-}
-
-func UnregisterClient(client *Client) {
-    mu.Lock()
-    defer mu.Unlock()
-    if _, ok := clients[client]; ok {
-        delete(clients, client)
-        client.Conn.Close()
-    }
+// channelPrefix is followed by the room in the Redis channel of each room
+const channelPrefix = "chat:"
+
+// Envelope is the message published to the replicas and sent as is to the sockets of the room
+type Envelope struct {
+	// ID is the entry of the envelope in the stream of its room, the clients send the last one they received to resume.
+	// The ephemeral envelopes have none.
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+	// The room of the envelope is an event or a conversation
+	EventID        uint            `json:"event_id,omitempty"`
+	ConversationID string          `json:"conversation_id,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// NewEnvelope encodes the payload in an envelope of the given type
+func NewEnvelope(envelopeType string, eventID uint, payload interface{}) (*Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{Type: envelopeType, EventID: eventID, Payload: data}, nil
+}
+
+// NewConversationEnvelope encodes the payload in an envelope of the given type for a conversation
+func NewConversationEnvelope(envelopeType string, conversationID string, payload interface{}) (*Envelope, error) {
+	envelope, err := NewEnvelope(envelopeType, 0, payload)
+	if err != nil {
+		return nil, err
+	}
+	envelope.ConversationID = conversationID
+	return envelope, nil
+}
+
+// SystemPayload tells a user why the server refused an action
+type SystemPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RetryAfter is the wait in milliseconds before the action is accepted again
+	RetryAfter int64 `json:"retry_after_ms,omitempty"`
+}
+
+// MemberPayload is the payload of the membership envelopes
+type MemberPayload struct {
+	UserID uint `json:"user_id"`
+}
+
+// EventRoom is the room of the sockets connected to the chat of an event
+func EventRoom(eventID uint) string {
+	return "event:" + strconv.FormatUint(uint64(eventID), 10)
+}
+
+// EventViewersRoom is the room of the clients showing an event, they receive its changes without taking part in its chat
+func EventViewersRoom(eventID uint) string {
+	return "event-viewers:" + strconv.FormatUint(uint64(eventID), 10)
+}
+
+// AttendeesPayload is the payload of the attendee changes of an event
+type AttendeesPayload struct {
+	UserID        uint  `json:"user_id"`
+	Joined        bool  `json:"joined"`
+	AttendeeCount int64 `json:"attendee_count"`
+}
+
+// ConversationRoom is the room of the sockets connected to a conversation
+func ConversationRoom(conversationID string) string {
+	return "conversation:" + conversationID
+}
+
+// UserRoom is the room of the sockets of a user which are not bound to an event
+func UserRoom(userID uint) string {
+	return "user:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+// Hub delivers the envelopes published by every replica to the sockets of their room connected to this replica
+type Hub struct {
+	rdb   *redis.Client
+	mu    sync.RWMutex
+	rooms map[string]map[*Client]struct{}
+}
+
+func NewHub(rdb *redis.Client) *Hub {
+	return &Hub{rdb: rdb, rooms: make(map[string]map[*Client]struct{})}
+}
+
+// Run forwards the envelopes published on Redis to the local sockets until the context is cancelled
+func (h *Hub) Run(ctx context.Context) {
+	// A single pattern subscription covers every room
+	pubsub := h.rdb.PSubscribe(ctx, channelPrefix+"*")
+	defer pubsub.Close()
+
+	// The channel of go-redis reconnects and subscribes again when the connection is lost
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			room := strings.TrimPrefix(msg.Channel, channelPrefix)
+			h.control(room, []byte(msg.Payload))
+			h.broadcast(room, []byte(msg.Payload))
+		}
+	}
+}
+
+// Publish sends the envelope to the sockets of the room on every replica, the chat envelopes are kept in the stream of the room
+func (h *Hub) Publish(ctx context.Context, room string, envelope *Envelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if streamed(envelope.Type) {
+		err = publishScript.Run(ctx, h.rdb, []string{streamPrefix + room}, publishArgs(room, data)...).Err()
+	} else {
+		err = h.rdb.Publish(ctx, channelPrefix+room, data).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to publish on %s: %w", channelPrefix+room, err)
+	}
+	return nil
+}
+
+// PublishMany sends the envelope to the sockets of several rooms in a single round trip
+func (h *Hub) PublishMany(ctx context.Context, rooms []string, envelope *Envelope) error {
+	if len(rooms) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	pipe := h.rdb.Pipeline()
+	for _, room := range rooms {
+		if streamed(envelope.Type) {
+			// The script is sent in full, a pipeline cannot fall back from EVALSHA
+			publishScript.Eval(ctx, pipe, []string{streamPrefix + room}, publishArgs(room, data)...)
+		} else {
+			pipe.Publish(ctx, channelPrefix+room, data)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to publish on %d rooms: %w", len(rooms), err)
+	}
+	return nil
+}
+
+// broadcast queues the data on the local sockets of the room, it never blocks on a slow socket
+func (h *Hub) broadcast(room string, data []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.rooms[room] {
+		client.Send(data)
+	}
+}
+
+// closingTypes are the envelopes which close the sockets of the user of their payload, with the reason sent to the user
+var closingTypes = map[string]string{
+	TypeMemberRemoved: "removed from the room",
+	TypeUserBanned:    "banned from the room",
+}
+
+// control applies the envelopes which change the sockets of the room, the others are only delivered
+func (h *Hub) control(room string, data []byte) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return
+	}
+	reason, ok := closingTypes[envelope.Type]
+	if !ok {
+		return
+	}
+	// The payloads of the closing envelopes all carry the user_id
+	var member MemberPayload
+	if err := json.Unmarshal(envelope.Payload, &member); err != nil {
+		return
+	}
+
+	// A user removed or banned from the room loses its sockets at once on every replica
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.rooms[room] {
+		if client.userID == member.UserID {
+			client.close(websocket.ClosePolicyViolation, reason)
+		}
+	}
+}
+
+// Register adds the client to its room
+func (h *Hub) Register(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[client.room]
+	if !ok {
+		room = make(map[*Client]struct{})
+		h.rooms[client.room] = room
+	}
+	room[client] = struct{}{}
+}
+
+// Unregister removes the client from its room and closes it
+func (h *Hub) Unregister(client *Client) {
+	h.mu.Lock()
+	if room, ok := h.rooms[client.room]; ok {
+		delete(room, client)
+		if len(room) == 0 {
+			delete(h.rooms, client.room)
+		}
+	}
+	h.mu.Unlock()
+	client.Close()
 }
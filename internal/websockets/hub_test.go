@@ -0,0 +1,150 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub starts a hub on the Redis server, like a replica of the service
+func newTestHub(t *testing.T, ctx context.Context, server *miniredis.Miniredis) *Hub {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	hub := NewHub(rdb)
+	go hub.Run(ctx)
+	return hub
+}
+
+// dialRoom opens a socket registered on the hub in the room of the event
+func dialRoom(t *testing.T, hub *Hub, eventID uint) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	registered := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, EventRoom(eventID), 1)
+		go client.WritePump()
+		hub.Register(client)
+		close(registered)
+		defer hub.Unregister(client)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	<-registered
+	return conn
+}
+
+// waitSubscribed waits until every hub subscribed to the rooms, the messages published before are lost
+func waitSubscribed(t *testing.T, server *miniredis.Miniredis, hubs int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for server.PubSubNumPat() < hubs {
+		if time.Now().After(deadline) {
+			t.Fatalf("the hubs did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHubDeliversToTheRoomOnOtherReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publisher := newTestHub(t, ctx, server)
+	receiver := newTestHub(t, ctx, server)
+	waitSubscribed(t, server, 2)
+
+	member := dialRoom(t, receiver, 1)
+	other := dialRoom(t, receiver, 2)
+
+	// The chat envelopes go through the stream of the room, the ephemeral ones are only published
+	for _, envelopeType := range []string{TypeChatMessage, TypeTypingStarted} {
+		t.Run(envelopeType, func(t *testing.T) {
+			envelope, err := NewEnvelope(envelopeType, 1, map[string]string{"content": "hello"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := publisher.Publish(ctx, EventRoom(1), envelope); err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+
+			member.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, data, err := member.ReadMessage()
+			if err != nil {
+				t.Fatalf("the socket of the event did not receive the envelope: %v", err)
+			}
+			var received Envelope
+			if err := json.Unmarshal(data, &received); err != nil {
+				t.Fatalf("decode %s: %v", data, err)
+			}
+			if received.Type != envelopeType || received.EventID != 1 {
+				t.Fatalf("received %s, want a %s of event 1", data, envelopeType)
+			}
+			if streamed(envelopeType) == (received.ID == "") {
+				t.Fatalf("received %s, the ID must be set only for the streamed envelopes", data)
+			}
+
+			other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, data, err := other.ReadMessage(); err == nil {
+				t.Fatalf("the socket of another event received %s", data)
+			}
+		})
+		// A read which timed out breaks the connection, the other room gets a new socket
+		other = dialRoom(t, receiver, 2)
+	}
+}
+
+func TestHubClosesTheSocketsOfARemovedMember(t *testing.T) {
+	server := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publisher := newTestHub(t, ctx, server)
+	receiver := newTestHub(t, ctx, server)
+	waitSubscribed(t, server, 2)
+
+	conn := dialRoom(t, receiver, 1)
+	envelope, err := NewEnvelope(TypeMemberRemoved, 1, MemberPayload{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, EventRoom(1), envelope); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		// The envelope itself may arrive before the close
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Fatalf("got %v, want a close %d", err, websocket.ClosePolicyViolation)
+		}
+		return
+	}
+}
@@ -0,0 +1,126 @@
+package websockets
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// PresenceTTL is how long a socket is reported online without refresh, it covers the replicas which crashed
+	PresenceTTL = 90 * time.Second
+	// PresenceRefreshPeriod is how often a connected socket refreshes its presence
+	PresenceRefreshPeriod = PresenceTTL / 3
+)
+
+// PresencePayload is the payload of the presence and typing envelopes
+type PresencePayload struct {
+	UserID uint `json:"user_id"`
+}
+
+// PresenceStatePayload is sent to a socket when it connects
+type PresenceStatePayload struct {
+	UserIDs []uint `json:"user_ids"`
+}
+
+// Presence tracks the sockets connected to each room in Redis, so every replica sees the same users.
+// Each room is a sorted set of "<user ID>:<socket ID>" scored by the expiry of the socket.
+type Presence struct {
+	rdb *redis.Client
+}
+
+func NewPresence(rdb *redis.Client) *Presence {
+	return &Presence{rdb: rdb}
+}
+
+func presenceKey(room string) string {
+	return "presence:" + room
+}
+
+// Join marks the socket online, first reports whether it is the only socket of the user in the room
+func (p *Presence) Join(ctx context.Context, room string, userID uint, socketID string) (first bool, err error) {
+	if err := p.Refresh(ctx, room, userID, socketID); err != nil {
+		return false, err
+	}
+	sockets, err := p.userSockets(ctx, room, userID)
+	return sockets == 1, err
+}
+
+// Refresh extends the presence of the socket
+func (p *Presence) Refresh(ctx context.Context, room string, userID uint, socketID string) error {
+	key := presenceKey(room)
+	expiry := time.Now().Add(PresenceTTL)
+	pipe := p.rdb.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(expiry.Unix()), Member: presenceMember(userID, socketID)})
+	pipe.ExpireAt(ctx, key, expiry)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Leave marks the socket offline, last reports whether the user has no other socket in the room
+func (p *Presence) Leave(ctx context.Context, room string, userID uint, socketID string) (last bool, err error) {
+	if err := p.rdb.ZRem(ctx, presenceKey(room), presenceMember(userID, socketID)).Err(); err != nil {
+		return false, err
+	}
+	sockets, err := p.userSockets(ctx, room, userID)
+	return sockets == 0, err
+}
+
+// Online returns the users with at least one live socket in the room
+func (p *Presence) Online(ctx context.Context, room string) ([]uint, error) {
+	members, err := p.live(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[uint]bool)
+	userIDs := make([]uint, 0, len(members))
+	for _, member := range members {
+		userID, ok := presenceUser(member)
+		if ok && !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs, nil
+}
+
+// userSockets counts the live sockets of the user in the room
+func (p *Presence) userSockets(ctx context.Context, room string, userID uint) (int, error) {
+	members, err := p.live(ctx, room)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, member := range members {
+		if memberUser, ok := presenceUser(member); ok && memberUser == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// live drops the expired sockets and returns the others
+func (p *Presence) live(ctx context.Context, room string) ([]string, error) {
+	key := presenceKey(room)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := p.rdb.ZRemRangeByScore(ctx, key, "-inf", "("+now).Err(); err != nil {
+		return nil, err
+	}
+	return p.rdb.ZRange(ctx, key, 0, -1).Result()
+}
+
+func presenceMember(userID uint, socketID string) string {
+	return strconv.FormatUint(uint64(userID), 10) + ":" + socketID
+}
+
+func presenceUser(member string) (uint, bool) {
+	userID, _, found := strings.Cut(member, ":")
+	if !found {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(userID, 10, 64)
+	return uint(id), err == nil
+}
@@ -0,0 +1,133 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// streamPrefix is followed by the room in the Redis stream keeping the recent envelopes of each room
+	streamPrefix = "chat:stream:"
+	// StreamMaxLength is the approximate number of envelopes kept by room for the clients which reconnect
+	StreamMaxLength = 1000
+	// StreamTTL removes the stream of a room which stays idle
+	StreamTTL = 24 * time.Hour
+	// replayPageSize is the number of envelopes read from the stream at once during a replay
+	replayPageSize = 100
+)
+
+// ErrResumeUnavailable means the stream does not reach back to the last envelope of the client anymore,
+// the client must load the history again
+var ErrResumeUnavailable = errors.New("the missed messages are not available anymore")
+
+// publishScript appends the envelope to the stream of the room and publishes it with the ID of its entry.
+// Both happen atomically so the live envelopes and the stream are in the same order.
+// KEYS[1] is the stream, ARGV[1] the envelope without ID, ARGV[2] the max length, ARGV[3] the TTL in ms, ARGV[4] the channel.
+var publishScript = redis.NewScript(`
+local id = redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[2], '*', 'envelope', ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('PUBLISH', ARGV[4], '{"id":"' .. id .. '",' .. string.sub(ARGV[1], 2))
+return id
+`)
+
+// streamed reports whether the envelopes of the type are kept in the stream of their room. The chat and event envelopes are,
+// the presence, the typing indicators, the read receipts and the user rooms are ephemeral or reloaded on connect.
+func streamed(envelopeType string) bool {
+	if envelopeType == TypeSystem || envelopeType == TypeMessageRead {
+		return false
+	}
+	return strings.HasPrefix(envelopeType, "chat.") || strings.HasPrefix(envelopeType, "event.")
+}
+
+// publishArgs are the arguments of publishScript for the room
+func publishArgs(room string, data []byte) []interface{} {
+	return []interface{}{data, StreamMaxLength, StreamTTL.Milliseconds(), channelPrefix + room}
+}
+
+// withID adds the ID of the stream entry to the encoded envelope, the envelopes are published without ID
+func withID(id string, data []byte) []byte {
+	return append([]byte(`{"id":"`+id+`",`), data[1:]...)
+}
+
+// parseStreamID splits a stream entry ID in its time and its sequence
+func parseStreamID(id string) (uint64, uint64, bool) {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	msValue, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seqValue, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return msValue, seqValue, true
+}
+
+// streamIDAfter reports whether the stream entry ID a comes after b
+func streamIDAfter(a, b string) bool {
+	aMs, aSeq, _ := parseStreamID(a)
+	bMs, bSeq, _ := parseStreamID(b)
+	return aMs > bMs || (aMs == bMs && aSeq > bSeq)
+}
+
+// Resume registers the client and sends it the envelopes of its room published after lastID, the ID of the last
+// envelope it received, then the live ones. The live envelopes are held during the replay and the ones already
+// replayed are dropped, so the client gets every envelope once and in order.
+// The write pump of the client must be running. It returns ErrResumeUnavailable when the stream was trimmed
+// after lastID, the client is registered anyway.
+func (h *Hub) Resume(ctx context.Context, client *Client, lastID string) error {
+	client.hold()
+	h.Register(client)
+	last := lastID
+	defer func() { client.release(last) }()
+
+	if _, _, ok := parseStreamID(lastID); !ok {
+		return ErrResumeUnavailable
+	}
+	key := streamPrefix + client.room
+	// The envelopes after lastID are complete only while lastID itself is still in the stream
+	found, err := h.rdb.XRangeN(ctx, key, lastID, lastID, 1).Result()
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return ErrResumeUnavailable
+	}
+
+	for {
+		entries, err := h.rdb.XRangeN(ctx, key, "("+last, "+", replayPageSize).Result()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if data, ok := entry.Values["envelope"].(string); ok && !client.push(withID(entry.ID, []byte(data))) {
+				// The client is closed
+				return nil
+			}
+			last = entry.ID
+		}
+		if len(entries) < replayPageSize {
+			return nil
+		}
+	}
+}
+
+// replayed reports whether the held envelope was already sent by the replay, the envelopes without ID never are
+func replayed(data []byte, lastID string) bool {
+	var envelope struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.ID == "" {
+		return false
+	}
+	return !streamIDAfter(envelope.ID, lastID)
+}